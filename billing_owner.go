@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+)
+
+// organisation member roles
+const (
+	organisationRoleMember       = "member"
+	organisationRoleBillingAdmin = "billing_admin"
+)
+
+// billingOwner is who a Stripe customer belongs to: the signed in user, or an
+// organisation they manage the billing of.
+type billingOwner struct {
+	user         *core.Record
+	organisation *core.Record
+}
+
+// field returns the customer and subscription field holding the owner.
+func (o *billingOwner) field() string {
+	if o.organisation != nil {
+		return "organisation_id"
+	}
+	return "user_id"
+}
+
+// id returns the ID of the user or organisation.
+func (o *billingOwner) id() string {
+	if o.organisation != nil {
+		return o.organisation.Id
+	}
+	return o.user.Id
+}
+
+// record returns the user or organisation record.
+func (o *billingOwner) record() *core.Record {
+	if o.organisation != nil {
+		return o.organisation
+	}
+	return o.user
+}
+
+// findBillingOwner returns the owner of a customer row, subscription or
+// charge from its user_id and organisation_id.
+func findBillingOwner(app core.App, userID, organisationID string) (*billingOwner, error) {
+	if organisationID != "" {
+		organisation, err := app.FindRecordById("organisation", organisationID)
+		if err != nil {
+			return nil, err
+		}
+		return &billingOwner{organisation: organisation}, nil
+	}
+
+	user, err := app.FindFirstRecordByData("user", "id", userID)
+	if err != nil {
+		return nil, err
+	}
+	return &billingOwner{user: user}, nil
+}
+
+// emailRecipients returns the users who get the billing emails of the owner:
+// the user, or the billing admins of the organisation.
+func (o *billingOwner) emailRecipients(app core.App) ([]*core.Record, error) {
+	if o.organisation == nil {
+		return []*core.Record{o.user}, nil
+	}
+
+	members, err := app.FindRecordsByFilter(
+		"organisation_member",
+		"organisation_id = {:organisationId} && role = {:role}",
+		"",
+		0,
+		0,
+		dbx.Params{"organisationId": o.organisation.Id, "role": organisationRoleBillingAdmin},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]string, 0, len(members))
+	for _, member := range members {
+		userIDs = append(userIDs, member.GetString("user_id"))
+	}
+	return app.FindRecordsByIds("user", userIDs)
+}
+
+// registerCustomerOwnerHooks keeps every customer row owned by either a user
+// or an organisation.
+func registerCustomerOwnerHooks(app core.App) {
+	app.OnRecordValidate("customer").BindFunc(func(e *core.RecordEvent) error {
+		if (e.Record.GetString("user_id") == "") == (e.Record.GetString("organisation_id") == "") {
+			return errors.New("customer must belong to either a user or an organisation")
+		}
+		return e.Next()
+	})
+}
+
+// isBillingAdmin reports whether a user may manage the billing of an
+// organisation: members with the billing_admin role. The user's own role
+// isn't trusted, users can change it on their own record.
+func isBillingAdmin(app core.App, user *core.Record, organisationID string) bool {
+	member, err := app.FindFirstRecordByFilter(
+		"organisation_member",
+		"organisation_id = {:organisationId} && user_id = {:userId}",
+		dbx.Params{"organisationId": organisationID, "userId": user.Id},
+	)
+	if err != nil {
+		return false
+	}
+	return member.GetString("role") == organisationRoleBillingAdmin
+}
+
+// resolveBillingOwner returns the owner a checkout or portal request bills:
+// the organisation given as "organisation_id" when the user is one of its
+// billing admins, the user themselves otherwise.
+func resolveBillingOwner(app core.App, user *core.Record, data map[string]interface{}) (*billingOwner, error) {
+	rawOrganisationID, ok := data["organisation_id"]
+	if !ok {
+		return &billingOwner{user: user}, nil
+	}
+	organisationID, ok := rawOrganisationID.(string)
+	if !ok || organisationID == "" {
+		return nil, &requestError{http.StatusBadRequest, "invalid organisation_id"}
+	}
+
+	// unknown organisations are reported like foreign ones, so their IDs
+	// can't be probed
+	if !isBillingAdmin(app, user, organisationID) {
+		return nil, &requestError{http.StatusForbidden, "not a billing admin of the organisation"}
+	}
+	organisation, err := app.FindRecordById("organisation", organisationID)
+	if err != nil {
+		return nil, &requestError{http.StatusForbidden, "not a billing admin of the organisation"}
+	}
+
+	return &billingOwner{user: user, organisation: organisation}, nil
+}
+
+// findOrCreateStripeCustomer returns the Stripe customer of the owner,
+// creating it and its customer row when the owner has none yet. New
+// customers get the email, and organisations their name, along with
+// metadata pointing back to the owner.
+func findOrCreateStripeCustomer(app core.App, owner *billingOwner, email string) (string, error) {
+	existingCustomerRecord, err := app.FindFirstRecordByData("customer", owner.field(), owner.id())
+	if err == nil {
+		return existingCustomerRecord.GetString("stripe_customer_id"), nil
+	}
+
+	customerParams := &stripe.CustomerParams{
+		Metadata: map[string]string{},
+	}
+	if email != "" {
+		customerParams.Email = stripe.String(email)
+	}
+	if owner.organisation != nil {
+		customerParams.Metadata["pocketbaseOrganisationID"] = owner.organisation.Id
+		if name := owner.organisation.GetString("name"); name != "" {
+			customerParams.Name = stripe.String(name)
+		}
+	} else {
+		customerParams.Metadata["pocketbaseUUID"] = owner.user.Id
+	}
+
+	stripeCustomer, err := customer.New(customerParams)
+	if err != nil {
+		app.Logger().Error("could not create customer", "error", err)
+		return "", &requestError{http.StatusBadRequest, "could not create Stripe customer"}
+	}
+
+	// upload customer to pocketbase
+	collection, err := app.FindCollectionByNameOrId("customer")
+	if err != nil {
+		app.Logger().Error("could not find collection customer", "error", err)
+		return "", &requestError{http.StatusInternalServerError, "could not find collection customer"}
+	}
+
+	newCustomerRecord := core.NewRecord(collection)
+	newCustomerRecord.Set(owner.field(), owner.id())
+	newCustomerRecord.Set("stripe_customer_id", stripeCustomer.ID)
+
+	if err = app.Save(newCustomerRecord); err != nil {
+		app.Logger().Error("could not save new customer record", "error", err)
+		return "", &requestError{http.StatusBadRequest, "could not create new customer"}
+	}
+
+	return stripeCustomer.ID, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestCustomerOwner(t *testing.T) {
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Cleanup()
+
+	registerCustomerOwnerHooks(app)
+	collection := ensureCustomerCollection(t, app)
+
+	for _, owners := range [][2]string{{"", ""}, {"user_test", "org_test"}} {
+		record := core.NewRecord(collection)
+		record.Set("user_id", owners[0])
+		record.Set("organisation_id", owners[1])
+		record.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(record); err == nil {
+			t.Fatalf("Expected a customer of user %q and organisation %q to be rejected", owners[0], owners[1])
+		}
+	}
+
+	for _, owners := range [][2]string{{"user_test", ""}, {"", "org_test"}} {
+		record := core.NewRecord(collection)
+		record.Set("user_id", owners[0])
+		record.Set("organisation_id", owners[1])
+		record.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(record); err != nil {
+			t.Fatalf("Expected a customer of user %q and organisation %q to be saved, got %v", owners[0], owners[1], err)
+		}
+	}
+}
+
+func TestOrganisationBilling(t *testing.T) {
+	// orgSetup signs in the test user as a member of the organisation with
+	// role, next to two other members
+	orgSetup := func(role string) func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+		return func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+			setupStripeMock(t)
+			stripeSuccessURL = "https://example.com/success"
+			stripeCancelURL = "https://example.com/cancel"
+			stripeBillingReturnURL = "https://example.com/return"
+			lastCheckoutSessionForm = nil
+			lastBillingPortalSessionForm = nil
+			lastCustomerForm = nil
+			registerCustomerOwnerHooks(app)
+			ensureCatalogPrice(t, app, "price_team", "recurring")
+			ensureSubscriptionCollection(t, app)
+			ensureCustomerCollection(t, app)
+			organisation := ensureOrganisationRecord(t, app)
+
+			user, token := authTokenForTestUser(t, app)
+			members := ensureOrganisationMemberCollection(t, app)
+			for userID, memberRole := range map[string]string{user.Id: role, "memberone": "member", "membertwo": "member"} {
+				if userID == user.Id && role == "" {
+					continue
+				}
+				member := core.NewRecord(members)
+				member.Set("organisation_id", organisation.Id)
+				member.Set("user_id", userID)
+				member.Set("role", memberRole)
+				if err := app.Save(member); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			scenario.Headers = map[string]string{
+				"Authorization": token,
+			}
+		}
+	}
+
+	saveOrganisationCustomer := func(t testing.TB, app *tests.TestApp) {
+		customerRecord := core.NewRecord(ensureCustomerCollection(t, app))
+		customerRecord.Set("organisation_id", "orgtest00000000")
+		customerRecord.Set("stripe_customer_id", "cus_org")
+		if err := app.Save(customerRecord); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "billing admin checks out a seat per member",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"organisation_id":"orgtest00000000","price":{"id":"price_team"},"quantity":1,"adjustable_quantity":true}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: orgSetup("billing_admin"),
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("customer", "organisation_id", "orgtest00000000")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("stripe_customer_id") != "cus_test" || record.GetString("user_id") != "" {
+					t.Fatalf("Expected an organisation customer cus_test, got %v", record)
+				}
+				if lastCustomerForm.Get("metadata[pocketbaseOrganisationID]") != "orgtest00000000" || lastCustomerForm.Get("metadata[pocketbaseUUID]") != "" || lastCustomerForm.Get("name") != "Acme" {
+					t.Fatalf("Unexpected customer parameters %v", lastCustomerForm)
+				}
+				if lastCheckoutSessionForm.Get("line_items[0][quantity]") != "3" || lastCheckoutSessionForm.Get("line_items[0][adjustable_quantity][enabled]") != "" {
+					t.Fatalf("Expected a fixed quantity of 3 seats, got %v", lastCheckoutSessionForm)
+				}
+			},
+		},
+		{
+			name:           "the Admin user role doesn't make members billing admins",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"organisation_id":"orgtest00000000","price":{"id":"price_team"}}`,
+			expectedStatus: http.StatusForbidden,
+			expectedContent: []string{
+				`"failure":"not a billing admin of the organisation"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup("member")(t, app, scenario)
+
+				users, err := app.FindCollectionByNameOrId("users")
+				if err != nil {
+					t.Fatal(err)
+				}
+				users.Fields.Add(&core.TextField{Name: "role"})
+				if err := app.Save(users); err != nil {
+					t.Fatal(err)
+				}
+				user, _ := authTokenForTestUser(t, app)
+				user.Set("role", "Admin")
+				if err := app.Save(user); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:           "plain members can't check out for the organisation",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"organisation_id":"orgtest00000000","price":{"id":"price_team"}}`,
+			expectedStatus: http.StatusForbidden,
+			expectedContent: []string{
+				`"failure":"not a billing admin of the organisation"`,
+			},
+			setup: orgSetup("member"),
+		},
+		{
+			name:           "outsiders can't check out for the organisation",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"organisation_id":"orgtest00000000","price":{"id":"price_team"}}`,
+			expectedStatus: http.StatusForbidden,
+			expectedContent: []string{
+				`"failure":"not a billing admin of the organisation"`,
+			},
+			setup: orgSetup(""),
+		},
+		{
+			name:           "organisation_id must be a string",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"organisation_id":1,"price":{"id":"price_team"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"invalid organisation_id"`,
+			},
+			setup: orgSetup("billing_admin"),
+		},
+		{
+			name:           "organisation with an active subscription is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"organisation_id":"orgtest00000000","price":{"id":"price_team"}}`,
+			expectedStatus: http.StatusConflict,
+			expectedContent: []string{
+				`"failure":"organisation already has an active subscription"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup("billing_admin")(t, app, scenario)
+				saveOrganisationCustomer(t, app)
+
+				subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+				subscription.Set("subscription_id", "sub_team")
+				subscription.Set("organisation_id", "orgtest00000000")
+				subscription.Set("status", "active")
+				subscription.Set("price_id", "price_team")
+				if err := app.Save(subscription); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:           "billing admin opens the organisation's portal",
+			method:         http.MethodPost,
+			url:            "/create-portal-link",
+			body:           `{"organisation_id":"orgtest00000000"}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"bps_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup("billing_admin")(t, app, scenario)
+				saveOrganisationCustomer(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if lastBillingPortalSessionForm.Get("customer") != "cus_org" {
+					t.Fatalf("Expected a portal session of cus_org, got %v", lastBillingPortalSessionForm)
+				}
+			},
+		},
+		{
+			name:           "plain members can't open the organisation's portal",
+			method:         http.MethodPost,
+			url:            "/create-portal-link",
+			body:           `{"organisation_id":"orgtest00000000"}`,
+			expectedStatus: http.StatusForbidden,
+			expectedContent: []string{
+				`"failure":"not a billing admin of the organisation"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup("member")(t, app, scenario)
+				saveOrganisationCustomer(t, app)
+			},
+		},
+	})
+}
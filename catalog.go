@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	stripePrice "github.com/stripe/stripe-go/v76/price"
+	stripeProduct "github.com/stripe/stripe-go/v76/product"
+)
+
+// upsertProduct mirrors a Stripe product into the product collection.
+// syncedAt is the creation time of the event (or the time of the API read)
+// the product comes from, and older data than what is stored is ignored.
+func upsertProduct(app core.App, product *stripe.Product, syncedAt int64) error {
+	collection, err := app.FindCollectionByNameOrId("product")
+	if err != nil {
+		app.Logger().Error("Could not find collection product", "error", err)
+		return newStripeEventError(http.StatusInternalServerError, "could not find collection product", err)
+	}
+
+	existingRecord, err := app.FindFirstRecordByData("product", "product_id", product.ID)
+	var recordToSave *core.Record
+
+	if err == nil && existingRecord != nil {
+		// existing record found, update it
+		recordToSave = existingRecord
+	} else {
+		// existing record not found, insert a new record
+		recordToSave = core.NewRecord(collection)
+	}
+
+	if isStaleStripeEvent(recordToSave, syncedAt) {
+		app.Logger().Info("skipping stale product update", "productId", product.ID)
+		return nil
+	}
+
+	recordToSave.Set("product_id", product.ID)
+	recordToSave.Set("active", product.Active)
+	recordToSave.Set("name", product.Name)
+	recordToSave.Set("description", coalesce(&product.Description, ""))
+	recordToSave.Set("metadata", product.Metadata)
+	recordToSave.Set("last_event_created", int64ToISODate(syncedAt))
+
+	if err = app.Save(recordToSave); err != nil {
+		app.Logger().Error("Could not save product record", "error", err)
+		return newStripeEventError(http.StatusInternalServerError, "could not save product record", err)
+	}
+
+	return nil
+}
+
+// upsertPrice mirrors a Stripe price into the price collection, see
+// upsertProduct for the meaning of syncedAt.
+func upsertPrice(app core.App, price *stripe.Price, syncedAt int64) error {
+	collection, err := app.FindCollectionByNameOrId("price")
+	if err != nil {
+		app.Logger().Error("Could not find collection price", "error", err)
+		return newStripeEventError(http.StatusInternalServerError, "could not find collection price", err)
+	}
+
+	existingRecord, err := app.FindFirstRecordByData("price", "price_id", price.ID)
+	var recordToSave *core.Record
+
+	if err == nil && existingRecord != nil {
+		// existing record found, update it
+		recordToSave = existingRecord
+	} else {
+		// existing record not found, insert a new record
+		recordToSave = core.NewRecord(collection)
+	}
+
+	if isStaleStripeEvent(recordToSave, syncedAt) {
+		app.Logger().Info("skipping stale price update", "priceId", price.ID)
+		return nil
+	}
+
+	recordToSave.Set("price_id", price.ID)
+	if price.Product != nil {
+		recordToSave.Set("product_id", price.Product.ID)
+	}
+	recordToSave.Set("active", price.Active)
+	recordToSave.Set("currency", price.Currency)
+	recordToSave.Set("description", price.Nickname)
+	recordToSave.Set("lookup_key", price.LookupKey)
+	recordToSave.Set("type", price.Type)
+	recordToSave.Set("unit_amount", price.UnitAmount)
+	recordToSave.Set("metadata", price.Metadata)
+	recordToSave.Set("last_event_created", int64ToISODate(syncedAt))
+
+	// check if recurring is not nil before accessing its fields
+	if price.Recurring != nil {
+		recordToSave.Set("interval", price.Recurring.Interval)
+		recordToSave.Set("interval_count", price.Recurring.IntervalCount)
+		recordToSave.Set("trial_period_days", price.Recurring.TrialPeriodDays)
+	}
+
+	if err = app.Save(recordToSave); err != nil {
+		app.Logger().Error("could not save price record", "error", err)
+		return newStripeEventError(http.StatusBadRequest, "could not save price record", err)
+	}
+
+	return nil
+}
+
+// deleteCatalogRecord handles a deleted Stripe product or price by marking
+// its record inactive with a deleted_at timestamp, or by removing the record
+// when STRIPE_CATALOG_HARD_DELETE is enabled.
+func deleteCatalogRecord(app core.App, collection, idField, id string, syncedAt int64) error {
+	existingRecord, err := app.FindFirstRecordByData(collection, idField, id)
+	if err != nil || existingRecord == nil {
+		// nothing to delete
+		return nil
+	}
+
+	// a record updated after this deletion event was sent must keep its data
+	if isStaleStripeEvent(existingRecord, syncedAt) {
+		app.Logger().Info("skipping stale "+collection+" deletion", idField, id)
+		return nil
+	}
+
+	if stripeCatalogHardDelete {
+		if err = app.Delete(existingRecord); err != nil {
+			app.Logger().Error("could not delete "+collection+" record", idField, id, "error", err)
+			return newStripeEventError(http.StatusInternalServerError, "could not delete "+collection+" record", err)
+		}
+		return nil
+	}
+
+	existingRecord.Set("active", false)
+	existingRecord.Set("deleted_at", int64ToISODate(syncedAt))
+	existingRecord.Set("last_event_created", int64ToISODate(syncedAt))
+
+	if err = app.Save(existingRecord); err != nil {
+		app.Logger().Error("could not save "+collection+" record", idField, id, "error", err)
+		return newStripeEventError(http.StatusInternalServerError, "could not save "+collection+" record", err)
+	}
+
+	return nil
+}
+
+// catalogSyncResult reports how many records a catalog backfill upserted.
+type catalogSyncResult struct {
+	Products int
+	Prices   int
+}
+
+// syncStripeCatalog pages through every product and price in the Stripe
+// account and upserts them with the same mapping the webhook uses.
+func syncStripeCatalog(app core.App) (*catalogSyncResult, error) {
+	result := &catalogSyncResult{}
+
+	// the listed objects are current as of now, so only newer events may
+	// overwrite them afterwards
+	syncedAt := time.Now().Unix()
+
+	productParams := &stripe.ProductListParams{}
+	productParams.Limit = stripe.Int64(100)
+	products := stripeProduct.List(productParams)
+	for products.Next() {
+		if err := upsertProduct(app, products.Product(), syncedAt); err != nil {
+			return result, fmt.Errorf("could not sync product %s: %w", products.Product().ID, err)
+		}
+		result.Products++
+	}
+	if err := products.Err(); err != nil {
+		return result, fmt.Errorf("could not list stripe products: %w", err)
+	}
+
+	priceParams := &stripe.PriceListParams{}
+	priceParams.Limit = stripe.Int64(100)
+	prices := stripePrice.List(priceParams)
+	for prices.Next() {
+		if err := upsertPrice(app, prices.Price(), syncedAt); err != nil {
+			return result, fmt.Errorf("could not sync price %s: %w", prices.Price().ID, err)
+		}
+		result.Prices++
+	}
+	if err := prices.Err(); err != nil {
+		return result, fmt.Errorf("could not list stripe prices: %w", err)
+	}
+
+	return result, nil
+}
+
+func handleSyncStripeCatalog(e *core.RequestEvent) error {
+	result, err := syncStripeCatalog(e.App)
+	if err != nil {
+		e.App.Logger().Error("could not sync stripe catalog", "error", err)
+		return e.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"failure":  "could not sync stripe catalog",
+			"products": result.Products,
+			"prices":   result.Prices,
+		})
+	}
+
+	return e.JSON(http.StatusOK, map[string]interface{}{
+		"success":  "catalog was synced",
+		"products": result.Products,
+		"prices":   result.Prices,
+	})
+}
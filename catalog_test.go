@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func TestSyncStripeCatalogEndpoint(t *testing.T) {
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "catalog sync requires superuser",
+			method:         http.MethodPost,
+			url:            "/stripe/sync/catalog",
+			expectedStatus: http.StatusUnauthorized,
+			expectedContent: []string{
+				`"data":{}`,
+			},
+		},
+		{
+			name:           "catalog sync upserts products and prices",
+			method:         http.MethodPost,
+			url:            "/stripe/sync/catalog",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"catalog was synced"`,
+				`"products":1`,
+				`"prices":1`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setupStripeMock(t)
+				ensureProductCollection(t, app)
+				ensurePriceCollection(t, app)
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				product, err := app.FindFirstRecordByData("product", "product_id", "prod_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if product.GetString("name") != "Test product" {
+					t.Fatalf("Expected product name to be Test product, got %s", product.GetString("name"))
+				}
+
+				price, err := app.FindFirstRecordByData("price", "price_id", "price_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if price.GetString("product_id") != "prod_test" {
+					t.Fatalf("Expected price product_id to be prod_test, got %s", price.GetString("product_id"))
+				}
+				if price.GetString("interval") != "month" {
+					t.Fatalf("Expected price interval to be month, got %s", price.GetString("interval"))
+				}
+				if price.GetString("lookup_key") != "pro_monthly" {
+					t.Fatalf("Expected price lookup_key to be pro_monthly, got %s", price.GetString("lookup_key"))
+				}
+			},
+		},
+	})
+}
+
+func TestCatalogDeleteEvents(t *testing.T) {
+	payloadProduct := []byte(fmt.Sprintf(`{"id":"evt_product_deleted","object":"event","api_version":"%s","created":1700000000,"type":"product.deleted","data":{"object":{"id":"prod_test","object":"product","active":false}}}`, stripe.APIVersion))
+	signedProduct := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadProduct,
+		Secret:  "whsec_test",
+	})
+
+	payloadPrice := []byte(fmt.Sprintf(`{"id":"evt_price_deleted","object":"event","api_version":"%s","created":1700000000,"type":"price.deleted","data":{"object":{"id":"price_test","object":"price","active":false}}}`, stripe.APIVersion))
+	signedPrice := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadPrice,
+		Secret:  "whsec_test",
+	})
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "product deleted marks product inactive",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadProduct),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedProduct.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				ensureStripeEventCollection(t, app)
+				collection := ensureProductCollection(t, app)
+				record := core.NewRecord(collection)
+				record.Set("product_id", "prod_test")
+				record.Set("active", true)
+				if err := app.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("product", "product_id", "prod_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetBool("active") {
+					t.Fatal("Expected deleted product to be inactive")
+				}
+				if record.GetDateTime("deleted_at").IsZero() {
+					t.Fatal("Expected deleted product to have deleted_at set")
+				}
+			},
+		},
+		{
+			name:           "price deleted removes price when hard deleting",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadPrice),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedPrice.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				stripeCatalogHardDelete = true
+				ensureStripeEventCollection(t, app)
+				collection := ensurePriceCollection(t, app)
+				record := core.NewRecord(collection)
+				record.Set("price_id", "price_test")
+				record.Set("active", true)
+				if err := app.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				defer func() { stripeCatalogHardDelete = false }()
+
+				if _, err := app.FindFirstRecordByData("price", "price_id", "price_test"); err == nil {
+					t.Fatal("Expected deleted price to be removed")
+				}
+			},
+		},
+	})
+}
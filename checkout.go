@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// checkoutPaymentStatusFailed is recorded for checkout sessions whose delayed
+// payment failed, which Stripe itself leaves as "unpaid".
+const checkoutPaymentStatusFailed = "failed"
+
+// checkoutPaymentStatus returns the payment status to record for a checkout
+// session event.
+func checkoutPaymentStatus(eventType stripe.EventType, checkoutSesh *stripe.CheckoutSession) string {
+	if eventType == "checkout.session.async_payment_failed" {
+		return checkoutPaymentStatusFailed
+	}
+	return string(checkoutSesh.PaymentStatus)
+}
+
+// upsertCheckoutSession records the state of a checkout session in the
+// checkout_session collection. See upsertSubscription for the meaning of
+// syncedAt. It returns a nil record when the stored session is newer and the
+// update was skipped.
+func upsertCheckoutSession(app core.App, checkoutSesh *stripe.CheckoutSession, paymentStatus string, syncedAt int64) (*core.Record, error) {
+	collection, err := app.FindCollectionByNameOrId("checkout_session")
+	if err != nil {
+		app.Logger().Error("could not find collection checkout_session", "error", err)
+		return nil, newStripeEventError(http.StatusInternalServerError, "could not find collection checkout_session", err)
+	}
+
+	existingRecord, err := app.FindFirstRecordByData("checkout_session", "checkout_session_id", checkoutSesh.ID)
+	var recordToSave *core.Record
+
+	if err == nil && existingRecord != nil {
+		recordToSave = existingRecord
+	} else {
+		recordToSave = core.NewRecord(collection)
+	}
+
+	if isStaleStripeEvent(recordToSave, syncedAt) {
+		app.Logger().Info("skipping stale checkout session update", "sessionId", checkoutSesh.ID)
+		return nil, nil
+	}
+
+	recordToSave.Set("checkout_session_id", checkoutSesh.ID)
+	if checkoutSesh.Customer != nil {
+		recordToSave.Set("stripe_customer_id", checkoutSesh.Customer.ID)
+
+		// expired sessions may belong to customers that were never mapped
+		if existingCustomer, err := app.FindFirstRecordByData("customer", "stripe_customer_id", checkoutSesh.Customer.ID); err == nil {
+			recordToSave.Set("user_id", existingCustomer.GetString("user_id"))
+			recordToSave.Set("organisation_id", existingCustomer.GetString("organisation_id"))
+		}
+	}
+	if checkoutSesh.Subscription != nil {
+		recordToSave.Set("subscription_id", checkoutSesh.Subscription.ID)
+	}
+	if checkoutSesh.PaymentIntent != nil {
+		recordToSave.Set("payment_intent", checkoutSesh.PaymentIntent.ID)
+	}
+	recordToSave.Set("mode", checkoutSesh.Mode)
+	recordToSave.Set("status", checkoutSesh.Status)
+	recordToSave.Set("payment_status", paymentStatus)
+	recordToSave.Set("last_event_created", int64ToISODate(syncedAt))
+
+	if err = app.Save(recordToSave); err != nil {
+		app.Logger().Error("could not save checkout session record", "sessionId", checkoutSesh.ID, "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "could not save checkout session record", err)
+	}
+
+	return recordToSave, nil
+}
+
+// setSubscriptionPaymentPending flags a subscription whose first payment
+// hasn't settled yet, so access isn't granted before the money arrives.
+func setSubscriptionPaymentPending(app core.App, subscriptionID string, pending bool) error {
+	record, err := app.FindFirstRecordByData("subscription", "subscription_id", subscriptionID)
+	if err != nil || record == nil || record.GetBool("payment_pending") == pending {
+		return nil
+	}
+
+	record.Set("payment_pending", pending)
+	setSubscriptionAccess(record)
+	if err = app.Save(record); err != nil {
+		app.Logger().Error("could not save subscription record", "subscriptionId", subscriptionID, "error", err)
+		return newStripeEventError(http.StatusBadRequest, "couldn't submit subscription update", err)
+	}
+
+	return nil
+}
+
+// syncCheckoutSession handles the checkout.session.* events. Sessions paid
+// with delayed payment methods (e.g. SEPA or ACH debits) complete as "unpaid"
+// and settle later with async_payment_succeeded or async_payment_failed, so
+// subscriptions stay payment_pending and orders unpaid until then.
+func syncCheckoutSession(app core.App, eventSync *stripeEventSync, eventType stripe.EventType, checkoutSesh *stripe.CheckoutSession, syncedAt int64) error {
+	paymentStatus := checkoutPaymentStatus(eventType, checkoutSesh)
+	sessionRecord, err := upsertCheckoutSession(app, checkoutSesh, paymentStatus, syncedAt)
+	if err != nil || sessionRecord == nil {
+		return err
+	}
+
+	// nothing was bought
+	if eventType == "checkout.session.expired" {
+		return nil
+	}
+
+	switch checkoutSesh.Mode {
+	case stripe.CheckoutSessionModeSubscription:
+		if checkoutSesh.Subscription == nil {
+			app.Logger().Error("could not find checkout session subscription")
+			return newStripeEventError(http.StatusBadRequest, "missing checkout subscription", nil)
+		}
+
+		// keep the subscription pending, Stripe cancels it once the
+		// payment can't be collected
+		if paymentStatus == checkoutPaymentStatusFailed {
+			return setSubscriptionPaymentPending(app, checkoutSesh.Subscription.ID, true)
+		}
+
+		// unexpanded subscriptions were fetched before the transaction, and
+		// the customer is the session's when the subscription lacks it
+		subscription := *checkoutSesh.Subscription
+		if eventSync.checkoutSubscription != nil {
+			subscription = *eventSync.checkoutSubscription
+		}
+		if subscription.Customer == nil {
+			subscription.Customer = checkoutSesh.Customer
+		}
+		if subscription.Customer == nil {
+			app.Logger().Error("could not find checkout session customer")
+			return newStripeEventError(http.StatusBadRequest, "missing checkout customer", nil)
+		}
+
+		// update subscription details
+		recordToSave, err := upsertSubscription(app, &subscription, syncedAt)
+		if err != nil {
+			return err
+		}
+
+		pending := paymentStatus == string(stripe.CheckoutSessionPaymentStatusUnpaid)
+		if err = setSubscriptionPaymentPending(app, subscription.ID, pending); err != nil {
+			return err
+		}
+
+		// update user details
+		if recordToSave != nil {
+			if err = updateUserPaymentDetails(app, recordToSave.GetString("user_id"), &subscription); err != nil {
+				return err
+			}
+		}
+
+	case stripe.CheckoutSessionModePayment:
+		// record one-time purchases
+		if _, err = upsertOrder(app, checkoutSesh, eventSync.lineItems, paymentStatus, syncedAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// maxCheckoutItems is the number of line items Stripe accepts in a single
+// checkout session.
+const maxCheckoutItems = 20
+
+// checkoutItem is a single line item requested for a checkout session, by
+// price ID or lookup key. The price ID of a lookup key and the price type are
+// taken from the price collection by resolveCheckoutItems, together with the
+// product.
+type checkoutItem struct {
+	PriceID            string
+	LookupKey          string
+	ProductID          string
+	PriceType          string
+	Quantity           int64
+	AdjustableQuantity bool
+}
+
+// parseCheckoutItems reads the line items from a create-checkout-session
+// body. The body either holds an "items" array of {price, quantity,
+// adjustable_quantity} entries, or a single entry. The error message is
+// reported back to the client.
+func parseCheckoutItems(data map[string]interface{}) ([]checkoutItem, error) {
+	rawItems, ok := data["items"]
+	if !ok {
+		item, err := parseCheckoutItem(data)
+		if err != nil {
+			return nil, err
+		}
+		return []checkoutItem{item}, nil
+	}
+
+	entries, ok := rawItems.([]interface{})
+	if !ok || len(entries) == 0 {
+		return nil, errors.New("invalid items")
+	}
+	if len(entries) > maxCheckoutItems {
+		return nil, errors.New("too many items")
+	}
+
+	items := make([]checkoutItem, 0, len(entries))
+	for _, rawEntry := range entries {
+		entry, ok := rawEntry.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid items")
+		}
+		item, err := parseCheckoutItem(entry)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// parseCheckoutItem reads a single {price, quantity, adjustable_quantity}
+// entry. The price is either a {id} object or given by a "lookup_key" in the
+// entry or the price object. The quantity defaults to 1.
+func parseCheckoutItem(entry map[string]interface{}) (checkoutItem, error) {
+	item := checkoutItem{Quantity: 1}
+
+	if rawQuantity, ok := entry["quantity"]; ok {
+		quantity, ok := rawQuantity.(float64)
+		if !ok || quantity < 1 || quantity != math.Trunc(quantity) {
+			return checkoutItem{}, errors.New("invalid quantity")
+		}
+		item.Quantity = int64(quantity)
+	}
+
+	price, _ := entry["price"].(map[string]interface{})
+	lookupKey, ok := entry["lookup_key"]
+	if !ok && price != nil {
+		lookupKey, ok = price["lookup_key"]
+	}
+	if ok {
+		if item.LookupKey, ok = lookupKey.(string); !ok || item.LookupKey == "" {
+			return checkoutItem{}, errors.New("invalid lookup key")
+		}
+	} else {
+		if price == nil {
+			return checkoutItem{}, errors.New("invalid price data")
+		}
+		if item.PriceID, ok = price["id"].(string); !ok || item.PriceID == "" {
+			return checkoutItem{}, errors.New("invalid price id")
+		}
+	}
+	if adjustable, ok := entry["adjustable_quantity"]; ok {
+		if item.AdjustableQuantity, ok = adjustable.(bool); !ok {
+			return checkoutItem{}, errors.New("invalid adjustable_quantity")
+		}
+	}
+
+	return item, nil
+}
+
+// resolveCheckoutItems looks the prices of the items up in the price
+// collection by ID or lookup key and fills in their ID and type. A lookup key
+// only matches active prices that weren't deleted. Unknown and inactive
+// prices, prices of inactive products and, with
+// STRIPE_CHECKOUT_PURCHASABLE_ONLY, prices without "purchasable" metadata are
+// rejected, so clients can only check out what the catalog offers. All prices
+// must share a currency and all recurring prices a billing interval, as Stripe
+// requires within one checkout session.
+func resolveCheckoutItems(app core.App, items []checkoutItem) error {
+	var currency, interval string
+	seen := map[string]bool{}
+	for i := range items {
+		var price *core.Record
+		var err error
+		if items[i].LookupKey != "" {
+			// archived prices may still carry the key they were moved away from
+			price, err = app.FindFirstRecordByFilter(
+				"price",
+				"lookup_key = {:lookupKey} && active = true && deleted_at = ''",
+				dbx.Params{"lookupKey": items[i].LookupKey},
+			)
+		} else {
+			price, err = app.FindFirstRecordByData("price", "price_id", items[i].PriceID)
+		}
+		if err != nil {
+			return errors.New("unknown price")
+		}
+		items[i].PriceID = price.GetString("price_id")
+		if seen[items[i].PriceID] {
+			return errors.New("duplicate price")
+		}
+		seen[items[i].PriceID] = true
+		if !price.GetBool("active") {
+			return errors.New("price is not active")
+		}
+		product, err := app.FindFirstRecordByData("product", "product_id", price.GetString("product_id"))
+		if err != nil || !product.GetBool("active") {
+			return errors.New("product is not active")
+		}
+		if stripeCheckoutPurchasableOnly {
+			var metadata map[string]string
+			if err := price.UnmarshalJSONField("metadata", &metadata); err != nil || metadata["purchasable"] != "true" {
+				return errors.New("price is not purchasable")
+			}
+		}
+
+		if currency != "" && price.GetString("currency") != currency {
+			return errors.New("prices must share a currency")
+		}
+		currency = price.GetString("currency")
+
+		items[i].ProductID = price.GetString("product_id")
+		items[i].PriceType = price.GetString("type")
+		if items[i].PriceType == "recurring" {
+			priceInterval := fmt.Sprintf("%d %s", price.GetInt("interval_count"), price.GetString("interval"))
+			if interval != "" && priceInterval != interval {
+				return errors.New("recurring prices must share a billing interval")
+			}
+			interval = priceInterval
+		}
+	}
+
+	return nil
+}
+
+// checkoutMode returns the checkout session mode for the items. Without a
+// requested mode, any recurring price makes it a subscription. Subscription
+// mode needs at least one recurring price and bills one_time prices on the
+// first invoice, payment mode only accepts one_time prices.
+func checkoutMode(items []checkoutItem, requested string) (stripe.CheckoutSessionMode, error) {
+	recurring := 0
+	for _, item := range items {
+		if item.PriceType == "recurring" {
+			recurring++
+		}
+	}
+
+	switch stripe.CheckoutSessionMode(requested) {
+	case "":
+		if recurring > 0 {
+			return stripe.CheckoutSessionModeSubscription, nil
+		}
+		return stripe.CheckoutSessionModePayment, nil
+	case stripe.CheckoutSessionModeSubscription:
+		if recurring == 0 {
+			return "", errors.New("subscription mode requires a recurring price")
+		}
+		return stripe.CheckoutSessionModeSubscription, nil
+	case stripe.CheckoutSessionModePayment:
+		if recurring > 0 {
+			return "", errors.New("recurring prices require subscription mode")
+		}
+		return stripe.CheckoutSessionModePayment, nil
+	}
+
+	return "", errors.New("invalid mode")
+}
+
+// checkoutLineItemParams converts the items to checkout session line items.
+func checkoutLineItemParams(items []checkoutItem) []*stripe.CheckoutSessionLineItemParams {
+	lineParams := make([]*stripe.CheckoutSessionLineItemParams, 0, len(items))
+	for _, item := range items {
+		lineItem := &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(item.PriceID),
+			Quantity: stripe.Int64(item.Quantity),
+		}
+		if item.AdjustableQuantity {
+			lineItem.AdjustableQuantity = &stripe.CheckoutSessionLineItemAdjustableQuantityParams{
+				Enabled: stripe.Bool(true),
+			}
+		}
+		lineParams = append(lineParams, lineItem)
+	}
+	return lineParams
+}
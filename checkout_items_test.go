@@ -0,0 +1,400 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// ensureCatalogPrice saves an active monthly usd price of the active product
+// prod_test.
+func ensureCatalogPrice(t testing.TB, app *tests.TestApp, priceID, priceType string) *core.Record {
+	t.Helper()
+
+	if _, err := app.FindFirstRecordByData("product", "product_id", "prod_test"); err != nil {
+		product := core.NewRecord(ensureProductCollection(t, app))
+		product.Set("product_id", "prod_test")
+		product.Set("active", true)
+		product.Set("name", "Test product")
+		if err := app.Save(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	price := core.NewRecord(ensurePriceCollection(t, app))
+	price.Set("price_id", priceID)
+	price.Set("product_id", "prod_test")
+	price.Set("active", true)
+	price.Set("currency", "usd")
+	price.Set("unit_amount", 1000)
+	price.Set("type", priceType)
+	if priceType == "recurring" {
+		price.Set("interval", "month")
+		price.Set("interval_count", 1)
+	}
+	if err := app.Save(price); err != nil {
+		t.Fatal(err)
+	}
+
+	return price
+}
+
+func TestCheckoutItems(t *testing.T) {
+	authSetup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+		setupStripeMock(t)
+		stripeSuccessURL = "https://example.com/success"
+		stripeCancelURL = "https://example.com/cancel"
+		lastCheckoutSessionForm = nil
+		ensureCatalogPrice(t, app, "price_base", "recurring")
+		ensureCatalogPrice(t, app, "price_seat", "recurring")
+		ensureCatalogPrice(t, app, "price_setup", "one_time")
+		ensureCatalogPrice(t, app, "price_a", "one_time")
+		ensureCatalogPrice(t, app, "price_b", "one_time")
+		ensureSubscriptionCollection(t, app)
+		ensureCustomerCollection(t, app)
+		_, token := authTokenForTestUser(t, app)
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "base plan with seats and a setup fee",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"items":[{"price":{"id":"price_base","type":"recurring"},"quantity":1},{"price":{"id":"price_seat","type":"recurring"},"quantity":5,"adjustable_quantity":true},{"price":{"id":"price_setup","type":"one_time"},"quantity":1}]}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: authSetup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				form := lastCheckoutSessionForm
+				if form.Get("mode") != "subscription" {
+					t.Fatalf("Expected subscription mode, got %s", form.Get("mode"))
+				}
+				expected := map[string]string{
+					"line_items[0][price]":                        "price_base",
+					"line_items[1][price]":                        "price_seat",
+					"line_items[1][quantity]":                     "5",
+					"line_items[1][adjustable_quantity][enabled]": "true",
+					"line_items[2][price]":                        "price_setup",
+				}
+				for key, value := range expected {
+					if form.Get(key) != value {
+						t.Fatalf("Expected %s to be %s, got %q", key, value, form.Get(key))
+					}
+				}
+				if form.Get("line_items[0][adjustable_quantity][enabled]") != "" {
+					t.Fatal("Expected the base plan quantity not to be adjustable")
+				}
+			},
+		},
+		{
+			name:           "one_time items use payment mode",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"items":[{"price":{"id":"price_a","type":"one_time"},"quantity":1},{"price":{"id":"price_b","type":"one_time"},"quantity":2}]}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: authSetup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if lastCheckoutSessionForm.Get("mode") != "payment" {
+					t.Fatalf("Expected payment mode, got %s", lastCheckoutSessionForm.Get("mode"))
+				}
+				if lastCheckoutSessionForm.Get("subscription_data[metadata]") != "" {
+					t.Fatal("Expected no subscription data in payment mode")
+				}
+			},
+		},
+		{
+			name:           "recurring price in payment mode is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"mode":"payment","items":[{"price":{"id":"price_a"},"quantity":1},{"price":{"id":"price_base"},"quantity":1}]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"recurring prices require subscription mode"`,
+			},
+			setup: authSetup,
+		},
+		{
+			name:           "subscription mode without a recurring price is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"mode":"subscription","items":[{"price":{"id":"price_a"},"quantity":1}]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"subscription mode requires a recurring price"`,
+			},
+			setup: authSetup,
+		},
+		{
+			name:           "empty items are rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"items":[]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"invalid items"`,
+			},
+		},
+		{
+			name:           "duplicate prices are rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"items":[{"price":{"id":"price_a","type":"recurring"},"quantity":1},{"price":{"id":"price_a","type":"recurring"},"quantity":2}]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"duplicate price"`,
+			},
+			setup: authSetup,
+		},
+		{
+			name:           "fractional quantity is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"items":[{"price":{"id":"price_a","type":"recurring"},"quantity":1.5}]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"invalid quantity"`,
+			},
+		},
+		{
+			name:           "price resolved by lookup key",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"lookup_key":"pro_monthly"}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				price := ensureCatalogPrice(t, app, "price_live", "recurring")
+				price.Set("lookup_key", "pro_monthly")
+				if err := app.Save(price); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				form := lastCheckoutSessionForm
+				if form.Get("line_items[0][price]") != "price_live" || form.Get("line_items[0][quantity]") != "1" {
+					t.Fatalf("Expected 1 price_live, got %s %s", form.Get("line_items[0][quantity]"), form.Get("line_items[0][price]"))
+				}
+			},
+		},
+		{
+			name:           "items mix lookup keys and price ids",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"items":[{"price":{"lookup_key":"pro_monthly"},"quantity":1},{"price":{"id":"price_seat"},"quantity":3}]}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				price := ensureCatalogPrice(t, app, "price_live", "recurring")
+				price.Set("lookup_key", "pro_monthly")
+				if err := app.Save(price); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				form := lastCheckoutSessionForm
+				if form.Get("line_items[0][price]") != "price_live" || form.Get("line_items[1][price]") != "price_seat" {
+					t.Fatalf("Unexpected line items %v", form)
+				}
+			},
+		},
+		{
+			name:           "lookup key skips archived prices",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"lookup_key":"pro_monthly"}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				archived := ensureCatalogPrice(t, app, "price_archived", "recurring")
+				archived.Set("lookup_key", "pro_monthly")
+				archived.Set("active", false)
+				archived.Set("deleted_at", "2023-11-14 22:13:20.000Z")
+				if err := app.Save(archived); err != nil {
+					t.Fatal(err)
+				}
+				price := ensureCatalogPrice(t, app, "price_live", "recurring")
+				price.Set("lookup_key", "pro_monthly")
+				if err := app.Save(price); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if price := lastCheckoutSessionForm.Get("line_items[0][price]"); price != "price_live" {
+					t.Fatalf("Expected the live price, got %s", price)
+				}
+			},
+		},
+		{
+			name:           "lookup key of an archived price is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"lookup_key":"pro_monthly"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"unknown price"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				archived := ensureCatalogPrice(t, app, "price_archived", "recurring")
+				archived.Set("lookup_key", "pro_monthly")
+				archived.Set("active", false)
+				if err := app.Save(archived); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:           "unknown lookup key is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"lookup_key":"enterprise_monthly"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"unknown price"`,
+			},
+			setup: authSetup,
+		},
+		{
+			name:           "unknown price is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_internal","type":"one_time"},"quantity":1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"unknown price"`,
+			},
+			setup: authSetup,
+		},
+		{
+			name:           "client supplied price type is ignored",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_base","type":"one_time"},"quantity":1}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: authSetup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if lastCheckoutSessionForm.Get("mode") != "subscription" {
+					t.Fatalf("Expected the stored recurring type to select subscription mode, got %s", lastCheckoutSessionForm.Get("mode"))
+				}
+			},
+		},
+		{
+			name:           "inactive price is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_archived"},"quantity":1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"price is not active"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				price := ensureCatalogPrice(t, app, "price_archived", "recurring")
+				price.Set("active", false)
+				if err := app.Save(price); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:           "price of an inactive product is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_base"},"quantity":1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"product is not active"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				product, err := app.FindFirstRecordByData("product", "product_id", "prod_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				product.Set("active", false)
+				if err := app.Save(product); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:           "prices with different intervals are rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"items":[{"price":{"id":"price_base"},"quantity":1},{"price":{"id":"price_yearly"},"quantity":1}]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"recurring prices must share a billing interval"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				price := ensureCatalogPrice(t, app, "price_yearly", "recurring")
+				price.Set("interval", "year")
+				if err := app.Save(price); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:           "price without purchasable metadata is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_base"},"quantity":1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"price is not purchasable"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				stripeCheckoutPurchasableOnly = true
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				stripeCheckoutPurchasableOnly = false
+			},
+		},
+		{
+			name:           "price with purchasable metadata is accepted",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_public"},"quantity":1}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				authSetup(t, app, scenario)
+				stripeCheckoutPurchasableOnly = true
+				price := ensureCatalogPrice(t, app, "price_public", "recurring")
+				price.Set("metadata", map[string]string{"purchasable": "true"})
+				if err := app.Save(price); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				stripeCheckoutPurchasableOnly = false
+			},
+		},
+	})
+}
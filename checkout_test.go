@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func ensureCheckoutSessionCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("checkout_session")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("checkout_session")
+	collection.Fields.Add(
+		&core.TextField{Name: "checkout_session_id", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "organisation_id"},
+		&core.TextField{Name: "stripe_customer_id"},
+		&core.TextField{Name: "mode"},
+		&core.TextField{Name: "status"},
+		&core.TextField{Name: "payment_status"},
+		&core.TextField{Name: "subscription_id"},
+		&core.TextField{Name: "payment_intent"},
+		&core.DateField{Name: "last_event_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func TestDelayedCheckoutPayments(t *testing.T) {
+	signedCheckoutEvent := func(eventID string, eventType string, created int64, session string) (string, string) {
+		payload := []byte(fmt.Sprintf(`{"id":"%s","object":"event","api_version":"%s","created":%d,"type":"%s","data":{"object":%s}}`, eventID, stripe.APIVersion, created, eventType, session))
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+			Payload: payload,
+			Secret:  "whsec_test",
+		})
+		return string(payload), signed.Header
+	}
+
+	subscriptionSession := func(paymentStatus string) string {
+		return `{"id":"cs_sepa","object":"checkout.session","mode":"subscription","status":"complete","payment_status":"` + paymentStatus + `","customer":"cus_test","subscription":{"id":"sub_sepa","object":"subscription","customer":"cus_test","status":"active","items":{"object":"list","data":[{"id":"si_sepa","object":"subscription_item","quantity":1,"price":{"id":"price_test","object":"price"}}]}}}`
+	}
+	unexpandedSession := `{"id":"cs_sepa","object":"checkout.session","mode":"subscription","status":"complete","payment_status":"paid","customer":"cus_test","subscription":"sub_sepa"}`
+	paymentSession := `{"id":"cs_payment","object":"checkout.session","mode":"payment","status":"complete","payment_status":"unpaid","customer":"cus_test","payment_intent":"pi_test","currency":"usd","amount_total":5000}`
+	expiredSession := `{"id":"cs_expired","object":"checkout.session","mode":"payment","status":"expired","payment_status":"unpaid","customer":"cus_test"}`
+
+	unpaidBody, unpaidHeader := signedCheckoutEvent("evt_checkout_unpaid", "checkout.session.completed", 1700000000, subscriptionSession("unpaid"))
+	succeededBody, succeededHeader := signedCheckoutEvent("evt_checkout_succeeded", "checkout.session.async_payment_succeeded", 1700000100, subscriptionSession("paid"))
+	failedBody, failedHeader := signedCheckoutEvent("evt_checkout_failed", "checkout.session.async_payment_failed", 1700000100, paymentSession)
+	subscriptionFailedBody, subscriptionFailedHeader := signedCheckoutEvent("evt_checkout_sub_failed", "checkout.session.async_payment_failed", 1700000100, subscriptionSession("unpaid"))
+	unexpandedBody, unexpandedHeader := signedCheckoutEvent("evt_checkout_unexpanded", "checkout.session.completed", 1700000000, unexpandedSession)
+	expiredBody, expiredHeader := signedCheckoutEvent("evt_checkout_expired", "checkout.session.expired", 1700000100, expiredSession)
+
+	setup := func(t testing.TB, app *tests.TestApp) {
+		WHSEC = "whsec_test"
+		setupStripeMock(t)
+		ensureStripeEventCollection(t, app)
+		ensureCheckoutSessionCollection(t, app)
+		ensureSubscriptionCollection(t, app)
+		ensureOrderCollection(t, app)
+		collection := ensureCustomerCollection(t, app)
+		record := core.NewRecord(collection)
+		record.Set("user_id", "user_test")
+		record.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "unpaid checkout keeps the subscription pending",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           unpaidBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": unpaidHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				subscription, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_sepa")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !subscription.GetBool("payment_pending") || subscription.GetBool("access") {
+					t.Fatal("Expected subscription to be payment_pending without access")
+				}
+
+				session, err := app.FindFirstRecordByData("checkout_session", "checkout_session_id", "cs_sepa")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if session.GetString("payment_status") != "unpaid" {
+					t.Fatalf("Expected checkout session payment_status to be unpaid, got %s", session.GetString("payment_status"))
+				}
+				if session.GetString("user_id") != "user_test" {
+					t.Fatalf("Expected checkout session user_id to be user_test, got %s", session.GetString("user_id"))
+				}
+			},
+		},
+		{
+			name:           "checkout with an unexpanded subscription fetches it",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           unexpandedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": unexpandedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				subscription, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_sepa")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if subscription.GetString("user_id") != "user_test" || subscription.GetString("status") != "active" || subscription.GetString("price_id") != "price_test" || !subscription.GetBool("access") {
+					t.Fatalf("Expected the fetched subscription to be synced, got %v", subscription)
+				}
+				if subscription.GetBool("payment_pending") {
+					t.Fatal("Expected subscription payment not to be pending")
+				}
+			},
+		},
+		{
+			name:           "async payment succeeded grants the subscription",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           succeededBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": succeededHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				record := core.NewRecord(ensureSubscriptionCollection(t, app))
+				record.Set("subscription_id", "sub_sepa")
+				record.Set("status", "active")
+				record.Set("payment_pending", true)
+				record.Set("last_event_created", int64ToISODate(1700000000))
+				if err := app.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				subscription, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_sepa")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if subscription.GetBool("payment_pending") || !subscription.GetBool("access") {
+					t.Fatal("Expected subscription payment to no longer be pending and to grant access")
+				}
+
+				session, err := app.FindFirstRecordByData("checkout_session", "checkout_session_id", "cs_sepa")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if session.GetString("payment_status") != "paid" {
+					t.Fatalf("Expected checkout session payment_status to be paid, got %s", session.GetString("payment_status"))
+				}
+			},
+		},
+		{
+			name:           "async payment failed keeps the subscription without access",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           subscriptionFailedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": subscriptionFailedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				record := core.NewRecord(ensureSubscriptionCollection(t, app))
+				record.Set("subscription_id", "sub_sepa")
+				record.Set("status", "active")
+				record.Set("access", true)
+				record.Set("last_event_created", int64ToISODate(1700000000))
+				if err := app.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				subscription, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_sepa")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !subscription.GetBool("payment_pending") || subscription.GetBool("access") {
+					t.Fatal("Expected subscription to be payment_pending without access")
+				}
+			},
+		},
+		{
+			name:           "async payment failed marks the order failed",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           failedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": failedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				order, err := app.FindFirstRecordByData("order", "checkout_session_id", "cs_payment")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if order.GetString("status") != "failed" {
+					t.Fatalf("Expected order status to be failed, got %s", order.GetString("status"))
+				}
+			},
+		},
+		{
+			name:           "expired checkout is tracked without an order",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           expiredBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": expiredHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				session, err := app.FindFirstRecordByData("checkout_session", "checkout_session_id", "cs_expired")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if session.GetString("status") != "expired" {
+					t.Fatalf("Expected checkout session status to be expired, got %s", session.GetString("status"))
+				}
+				if _, err := app.FindFirstRecordByData("order", "checkout_session_id", "cs_expired"); err == nil {
+					t.Fatal("Expected expired checkout not to create an order")
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// newStripeCommand creates the "stripe" console command with its maintenance
+// subcommands.
+func newStripeCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "stripe",
+		Short: "Manages the Stripe data mirrored in PocketBase",
+	}
+
+	command.AddCommand(newStripeReplayCommand(app))
+	command.AddCommand(newStripeSyncCommand(app))
+	command.AddCommand(newStripeDriftCommand(app))
+
+	return command
+}
+
+func newStripeReplayCommand(app core.App) *cobra.Command {
+	var from, to string
+	var deadLetterOnly, syncOnly bool
+
+	command := &cobra.Command{
+		Use:   "replay [event id]",
+		Short: "Re-runs the webhook sync for stored Stripe events",
+		Long:  "Re-runs the webhook sync for a single stored event, every event created within --from/--to, or every event in the dead-letter state. --sync-only skips side effects such as reminder emails.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if len(args) == 1 {
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", args[0])
+				if err != nil {
+					return fmt.Errorf("could not find stripe event %s: %w", args[0], err)
+				}
+				if err = replayStripeEvent(app, record, syncOnly); err != nil {
+					return err
+				}
+				fmt.Printf("Replayed %s\n", args[0])
+				return nil
+			}
+
+			var fromDate, toDate types.DateTime
+			var err error
+			if from != "" {
+				if fromDate, err = types.ParseDateTime(from); err != nil {
+					return fmt.Errorf("invalid --from date: %w", err)
+				}
+			}
+			if to != "" {
+				if toDate, err = types.ParseDateTime(to); err != nil {
+					return fmt.Errorf("invalid --to date: %w", err)
+				}
+			}
+			if fromDate.IsZero() && toDate.IsZero() && !deadLetterOnly {
+				return errors.New("an event id, a --from/--to range or --dead-letter is required")
+			}
+
+			records, err := findStripeEventsToReplay(app, fromDate, toDate, deadLetterOnly)
+			if err != nil {
+				return err
+			}
+
+			replayed := replayStripeEvents(app, records, syncOnly)
+			fmt.Printf("Replayed %d of %d events\n", replayed, len(records))
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&from, "from", "", "replay events created at or after this date (RFC3339)")
+	command.Flags().StringVar(&to, "to", "", "replay events created at or before this date (RFC3339)")
+	command.Flags().BoolVar(&deadLetterOnly, "dead-letter", false, "replay only events in the dead-letter state")
+	command.Flags().BoolVar(&syncOnly, "sync-only", false, "only sync the database, without side effects such as reminder emails")
+
+	return command
+}
+
+func newStripeSyncCommand(app core.App) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "sync",
+		Short: "Backfills PocketBase from the Stripe API",
+	}
+
+	command.AddCommand(&cobra.Command{
+		Use:   "catalog",
+		Short: "Upserts every Stripe product and price",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			result, err := syncStripeCatalog(app)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Synced %d products and %d prices\n", result.Products, result.Prices)
+			return nil
+		},
+	})
+
+	command.AddCommand(&cobra.Command{
+		Use:   "subscriptions",
+		Short: "Creates missing customers and repairs drifted subscriptions",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			report, err := reconcileStripeSubscriptions(app)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Created %d customers\n", len(report.CustomersCreated))
+			fmt.Printf("Created %d subscriptions\n", len(report.SubscriptionsCreated))
+			fmt.Printf("Repaired %d subscriptions\n", len(report.SubscriptionsRepaired))
+			for _, repair := range report.SubscriptionsRepaired {
+				for _, drift := range repair.Drift {
+					fmt.Printf("  %s %s: %s -> %s\n", repair.SubscriptionID, drift.Field, drift.Stored, drift.Stripe)
+				}
+			}
+			for _, reportErr := range report.Errors {
+				fmt.Printf("Error: %s\n", reportErr)
+			}
+			return nil
+		},
+	})
+
+	return command
+}
+
+func newStripeDriftCommand(app core.App) *cobra.Command {
+	return &cobra.Command{
+		Use:   "drift",
+		Short: "Reports subscriptions that disagree with Stripe without changing them",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			report, err := runDriftCheck(app)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Checked %d subscriptions\n", report.Checked)
+			fmt.Printf("%d drifted, %d missing in Stripe\n", len(report.Drifted), len(report.MissingInStripe))
+			for _, drifted := range report.Drifted {
+				for _, drift := range drifted.Drift {
+					fmt.Printf("  %s %s: %s (stored) != %s (stripe)\n", drifted.SubscriptionID, drift.Field, drift.Stored, drift.Stripe)
+				}
+			}
+			for _, subscriptionID := range report.MissingInStripe {
+				fmt.Printf("  %s is missing in Stripe\n", subscriptionID)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// driftReport lists the stored subscriptions that disagree with Stripe.
+type driftReport struct {
+	Checked         int                  `json:"checked"`
+	Drifted         []subscriptionRepair `json:"drifted"`
+	MissingInStripe []string             `json:"missing_in_stripe"`
+}
+
+// checkSubscriptionDrift compares every row of the subscription collection
+// against Stripe without changing anything.
+func checkSubscriptionDrift(app core.App) (*driftReport, error) {
+	report := &driftReport{
+		Drifted:         []subscriptionRepair{},
+		MissingInStripe: []string{},
+	}
+
+	subscriptionParams := &stripe.SubscriptionListParams{
+		Status: stripe.String("all"),
+	}
+	subscriptionParams.Limit = stripe.Int64(100)
+	subscriptions := stripeSubscription.List(subscriptionParams)
+
+	stripeSubscriptions := map[string]*stripe.Subscription{}
+	for subscriptions.Next() {
+		subscription := subscriptions.Subscription()
+		stripeSubscriptions[subscription.ID] = subscription
+	}
+	if err := subscriptions.Err(); err != nil {
+		return report, fmt.Errorf("could not list stripe subscriptions: %w", err)
+	}
+
+	records, err := app.FindAllRecords("subscription")
+	if err != nil {
+		return report, err
+	}
+
+	for _, record := range records {
+		report.Checked++
+
+		subscriptionID := record.GetString("subscription_id")
+		subscription, ok := stripeSubscriptions[subscriptionID]
+		if !ok {
+			report.MissingInStripe = append(report.MissingInStripe, subscriptionID)
+			continue
+		}
+
+		if drift := subscriptionDrift(record, subscription); len(drift) > 0 {
+			report.Drifted = append(report.Drifted, subscriptionRepair{
+				SubscriptionID: subscriptionID,
+				Drift:          drift,
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// saveDriftReport stores the report in the stripe_drift_report collection.
+func saveDriftReport(app core.App, report *driftReport) (*core.Record, error) {
+	collection, err := app.FindCollectionByNameOrId("stripe_drift_report")
+	if err != nil {
+		return nil, err
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("checked", report.Checked)
+	record.Set("drifted", len(report.Drifted))
+	record.Set("missing_in_stripe", len(report.MissingInStripe))
+	record.Set("details", report)
+
+	if err = app.Save(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// runDriftCheck checks for drift, logs a summary and stores the report.
+func runDriftCheck(app core.App) (*driftReport, error) {
+	report, err := checkSubscriptionDrift(app)
+	if err != nil {
+		return report, err
+	}
+
+	app.Logger().Info(
+		"checked stripe subscription drift",
+		"checked", report.Checked,
+		"drifted", len(report.Drifted),
+		"missingInStripe", len(report.MissingInStripe),
+	)
+
+	if _, err = saveDriftReport(app, report); err != nil {
+		return report, fmt.Errorf("could not save drift report: %w", err)
+	}
+
+	return report, nil
+}
+
+func handleCheckSubscriptionDrift(e *core.RequestEvent) error {
+	report, err := runDriftCheck(e.App)
+	if err != nil {
+		e.App.Logger().Error("could not check stripe subscription drift", "error", err)
+		return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not check subscription drift"})
+	}
+
+	return e.JSON(http.StatusOK, map[string]interface{}{
+		"success": "drift was checked",
+		"report":  report,
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func ensureDriftReportCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("stripe_drift_report")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("stripe_drift_report")
+	collection.Fields.Add(
+		&core.NumberField{Name: "checked", OnlyInt: true},
+		&core.NumberField{Name: "drifted", OnlyInt: true},
+		&core.NumberField{Name: "missing_in_stripe", OnlyInt: true},
+		&core.JSONField{Name: "details"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func TestCheckSubscriptionDriftEndpoint(t *testing.T) {
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "drift check requires superuser",
+			method:         http.MethodPost,
+			url:            "/stripe/drift",
+			expectedStatus: http.StatusUnauthorized,
+			expectedContent: []string{
+				`"data":{}`,
+			},
+		},
+		{
+			name:           "drift check reports without changing rows",
+			method:         http.MethodPost,
+			url:            "/stripe/drift",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"drift was checked"`,
+				`"checked":2`,
+				`"subscription_id":"sub_drifted"`,
+				`{"field":"status","stored":"active","stripe":"canceled"}`,
+				`"missing_in_stripe":["sub_gone"]`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setupStripeMock(t)
+				ensureDriftReportCollection(t, app)
+				collection := ensureSubscriptionCollection(t, app)
+
+				for _, subscriptionID := range []string{"sub_drifted", "sub_gone"} {
+					record := core.NewRecord(collection)
+					record.Set("subscription_id", subscriptionID)
+					record.Set("status", "active")
+					record.Set("price_id", "price_test")
+					record.Set("quantity", 2)
+					record.Set("current_period_start", int64ToISODate(1700000000))
+					record.Set("current_period_end", int64ToISODate(1702592000))
+					if err := app.Save(record); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				drifted, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_drifted")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if drifted.GetString("status") != "active" {
+					t.Fatalf("Expected drift check not to change the subscription, got status %s", drifted.GetString("status"))
+				}
+
+				reports, err := app.FindAllRecords("stripe_drift_report")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(reports) != 1 {
+					t.Fatalf("Expected 1 drift report, got %d", len(reports))
+				}
+				if reports[0].GetInt("drifted") != 1 || reports[0].GetInt("missing_in_stripe") != 1 {
+					t.Fatalf("Expected 1 drifted and 1 missing subscription, got %d and %d", reports[0].GetInt("drifted"), reports[0].GetInt("missing_in_stripe"))
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/stripe/stripe-go/v76"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// dunning statuses
+const (
+	dunningStatusOpen     = "open"
+	dunningStatusResolved = "resolved"
+	dunningStatusClosed   = "closed"
+	dunningStatusRevoked  = "revoked"
+)
+
+// openDunning returns the dunning record of a subscription, starting a new
+// dunning period with a fresh grace period when none is open. The record is
+// not saved.
+func openDunning(app core.App, subscriptionID, userID string) (*core.Record, error) {
+	record, err := app.FindFirstRecordByData("dunning", "subscription_id", subscriptionID)
+	if err != nil || record == nil {
+		collection, err := app.FindCollectionByNameOrId("dunning")
+		if err != nil {
+			app.Logger().Error("could not find collection dunning", "error", err)
+			return nil, newStripeEventError(http.StatusInternalServerError, "could not find collection dunning", err)
+		}
+		record = core.NewRecord(collection)
+		record.Set("subscription_id", subscriptionID)
+	}
+
+	if record.GetString("status") != dunningStatusOpen {
+		now := time.Now()
+		record.Set("status", dunningStatusOpen)
+		record.Set("attempts", 0)
+		record.Set("first_failed_at", now.UTC().Format(time.RFC3339))
+		record.Set("resolved_at", "")
+		record.Set("grace_ends_at", "")
+		if stripeDunningGracePeriod > 0 {
+			record.Set("grace_ends_at", now.Add(stripeDunningGracePeriod).UTC().Format(time.RFC3339))
+		}
+	}
+	if userID != "" {
+		record.Set("user_id", userID)
+	}
+
+	return record, nil
+}
+
+// recordDunningFailure counts a failed payment of a subscription invoice and
+// schedules a reminder with a link to the billing portal, which is sent once
+// the event is committed. The attempt count comes from Stripe and is kept per
+// invoice, so replayed events don't send the reminder twice while the failed
+// attempts of a new invoice, e.g. after the previous one was voided, do.
+func recordDunningFailure(app core.App, eventSync *stripeEventSync, invoiceRecord *core.Record) error {
+	subscriptionID := invoiceRecord.GetString("subscription_id")
+	if subscriptionID == "" {
+		// one-off invoices have no access to revoke
+		return nil
+	}
+
+	record, err := openDunning(app, subscriptionID, invoiceRecord.GetString("user_id"))
+	if err != nil {
+		return err
+	}
+
+	attempts := invoiceRecord.GetInt("attempt_count")
+	sameInvoice := record.GetString("invoice_id") == invoiceRecord.GetString("invoice_id")
+	if sameInvoice && attempts <= record.GetInt("attempts") {
+		return nil
+	}
+
+	record.Set("attempts", attempts)
+	record.Set("invoice_id", invoiceRecord.GetString("invoice_id"))
+	record.Set("last_failed_at", time.Now().UTC().Format(time.RFC3339))
+
+	if err = app.Save(record); err != nil {
+		app.Logger().Error("could not save dunning record", "subscriptionId", subscriptionID, "error", err)
+		return newStripeEventError(http.StatusBadRequest, "could not save dunning record", err)
+	}
+
+	eventSync.after(func(app core.App) error {
+		if err := sendDunningReminder(app, record, invoiceRecord); err != nil {
+			return fmt.Errorf("could not send dunning reminder of subscription %s: %w", subscriptionID, err)
+		}
+
+		record.Set("last_reminder_at", time.Now().UTC().Format(time.RFC3339))
+		return app.Save(record)
+	})
+
+	return nil
+}
+
+// sendDunningReminder emails the owner of a dunning record's subscription a
+// fresh billing portal link to update their payment method, once per failed
+// attempt of the invoice.
+func sendDunningReminder(app core.App, record *core.Record, invoiceRecord *core.Record) error {
+	// subscriptions of organisations are stored without a user
+	organisationID := ""
+	if subscriptionRecord, err := app.FindFirstRecordByData("subscription", "subscription_id", record.GetString("subscription_id")); err == nil {
+		organisationID = subscriptionRecord.GetString("organisation_id")
+	}
+	owner, err := findBillingOwner(app, record.GetString("user_id"), organisationID)
+	if err != nil {
+		return fmt.Errorf("could not find the billing owner of subscription %s: %w", record.GetString("subscription_id"), err)
+	}
+
+	key := fmt.Sprintf("payment_failed:%s:%d", invoiceRecord.GetString("invoice_id"), record.GetInt("attempts"))
+	return sendReminderOnce(app, key, owner, "payment_failed", func() (map[string]any, error) {
+		portal, err := newBillingPortalSession(invoiceRecord.GetString("stripe_customer_id"))
+		if err != nil {
+			return nil, fmt.Errorf("could not create billing portal session: %w", err)
+		}
+
+		data := map[string]any{
+			"invoice":    invoiceRecord.PublicExport(),
+			"amount":     formatAmount(int64(invoiceRecord.GetInt("amount_due")), invoiceRecord.GetString("currency")),
+			"attempts":   record.GetInt("attempts"),
+			"portal_url": portal.URL,
+		}
+		if graceEndsAt := record.GetDateTime("grace_ends_at"); !graceEndsAt.IsZero() {
+			data["grace_ends_at"] = formatEmailDate(graceEndsAt.Time())
+		}
+		return data, nil
+	})
+}
+
+// closeDunning ends the open dunning period of a subscription with status.
+func closeDunning(app core.App, subscriptionID, status string) error {
+	if subscriptionID == "" {
+		return nil
+	}
+
+	record, err := app.FindFirstRecordByData("dunning", "subscription_id", subscriptionID)
+	if err != nil || record.GetString("status") != dunningStatusOpen {
+		return nil
+	}
+
+	record.Set("status", status)
+	record.Set("resolved_at", time.Now().UTC().Format(time.RFC3339))
+	if err = app.Save(record); err != nil {
+		app.Logger().Error("could not save dunning record", "subscriptionId", subscriptionID, "error", err)
+		return newStripeEventError(http.StatusBadRequest, "could not save dunning record", err)
+	}
+
+	return nil
+}
+
+// syncSubscriptionDunning opens a dunning period when a subscription moves to
+// past_due or unpaid and closes it once the subscription recovers or ends.
+func syncSubscriptionDunning(app core.App, subscriptionRecord *core.Record) error {
+	subscriptionID := subscriptionRecord.GetString("subscription_id")
+
+	switch stripe.SubscriptionStatus(subscriptionRecord.GetString("status")) {
+	case stripe.SubscriptionStatusPastDue, stripe.SubscriptionStatusUnpaid:
+		record, err := openDunning(app, subscriptionID, subscriptionRecord.GetString("user_id"))
+		if err != nil || !record.IsNew() {
+			return err
+		}
+		if err = app.Save(record); err != nil {
+			app.Logger().Error("could not save dunning record", "subscriptionId", subscriptionID, "error", err)
+			return newStripeEventError(http.StatusBadRequest, "could not save dunning record", err)
+		}
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing:
+		return closeDunning(app, subscriptionID, dunningStatusResolved)
+	case stripe.SubscriptionStatusCanceled, stripe.SubscriptionStatusIncompleteExpired:
+		return closeDunning(app, subscriptionID, dunningStatusClosed)
+	}
+
+	return nil
+}
+
+// revokeExpiredDunning cancels the subscriptions whose grace period ended
+// without a successful payment and returns how many were revoked.
+func revokeExpiredDunning(app core.App) (int, error) {
+	records, err := app.FindRecordsByFilter(
+		"dunning",
+		"status = {:status} && grace_ends_at != '' && grace_ends_at <= {:now}",
+		"grace_ends_at",
+		0,
+		0,
+		dbx.Params{"status": dunningStatusOpen, "now": types.NowDateTime().String()},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, record := range records {
+		subscriptionID := record.GetString("subscription_id")
+
+		// the resulting customer.subscription.deleted event updates the subscription
+		if _, err := stripeSubscription.Cancel(subscriptionID, nil); err != nil {
+			app.Logger().Error("could not cancel subscription after grace period", "subscriptionId", subscriptionID, "error", err)
+			continue
+		}
+
+		record.Set("status", dunningStatusRevoked)
+		record.Set("resolved_at", time.Now().UTC().Format(time.RFC3339))
+		if err := app.Save(record); err != nil {
+			app.Logger().Error("could not save dunning record", "subscriptionId", subscriptionID, "error", err)
+			continue
+		}
+		revoked++
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func ensureDunningCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("dunning")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("dunning")
+	collection.Fields.Add(
+		&core.TextField{Name: "subscription_id", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "invoice_id"},
+		&core.SelectField{Name: "status", MaxSelect: 1, Values: []string{"open", "resolved", "closed", "revoked"}},
+		&core.NumberField{Name: "attempts", OnlyInt: true},
+		&core.DateField{Name: "first_failed_at"},
+		&core.DateField{Name: "last_failed_at"},
+		&core.DateField{Name: "last_reminder_at"},
+		&core.DateField{Name: "grace_ends_at"},
+		&core.DateField{Name: "resolved_at"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func TestDunningEvents(t *testing.T) {
+	signedInvoiceEvent := func(eventID string, eventType string, created int64, status string, attempts int) (string, string) {
+		payload := []byte(fmt.Sprintf(`{"id":"%s","object":"event","api_version":"%s","created":%d,"type":"%s","data":{"object":{"id":"in_dunning","object":"invoice","customer":"cus_test","subscription":"sub_dunning","status":"%s","currency":"usd","amount_due":1000,"attempt_count":%d}}}`, eventID, stripe.APIVersion, created, eventType, status, attempts))
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+			Payload: payload,
+			Secret:  "whsec_test",
+		})
+		return string(payload), signed.Header
+	}
+
+	failedBody, failedHeader := signedInvoiceEvent("evt_payment_failed", "invoice.payment_failed", 1700000000, "open", 1)
+	paidBody, paidHeader := signedInvoiceEvent("evt_invoice_paid", "invoice.paid", 1700000100, "paid", 2)
+
+	setup := func(t testing.TB, app *tests.TestApp) {
+		WHSEC = "whsec_test"
+		setupStripeMock(t)
+		ensureStripeEventCollection(t, app)
+		ensureInvoiceCollection(t, app)
+		ensureDunningCollection(t, app)
+		ensureSentReminderCollection(t, app)
+		user := ensureUserRecord(t, app)
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", user.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saveDunning := func(t testing.TB, app *tests.TestApp, invoiceID string, attempts int) {
+		record := core.NewRecord(ensureDunningCollection(t, app))
+		record.Set("subscription_id", "sub_dunning")
+		record.Set("user_id", "usertest0000000")
+		record.Set("invoice_id", invoiceID)
+		record.Set("status", dunningStatusOpen)
+		record.Set("attempts", attempts)
+		if err := app.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "failed payment opens dunning and sends a reminder",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           failedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": failedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("dunning", "subscription_id", "sub_dunning")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != dunningStatusOpen || record.GetInt("attempts") != 1 {
+					t.Fatalf("Expected an open dunning with 1 attempt, got %s %d", record.GetString("status"), record.GetInt("attempts"))
+				}
+				if record.GetString("user_id") != "usertest0000000" {
+					t.Fatalf("Expected dunning user_id to be usertest0000000, got %s", record.GetString("user_id"))
+				}
+				if record.GetDateTime("grace_ends_at").IsZero() {
+					t.Fatal("Expected dunning grace_ends_at to be set")
+				}
+				if record.GetDateTime("last_reminder_at").IsZero() {
+					t.Fatal("Expected dunning last_reminder_at to be set")
+				}
+
+				if app.TestMailer.TotalSend() != 1 {
+					t.Fatalf("Expected 1 reminder email, got %d", app.TestMailer.TotalSend())
+				}
+				message := app.TestMailer.LastMessage()
+				if message.To[0].Address != "test@example.com" {
+					t.Fatalf("Expected reminder to be sent to test@example.com, got %s", message.To[0].Address)
+				}
+				if !strings.Contains(message.HTML, "https://example.com/portal") {
+					t.Fatalf("Expected reminder to contain the billing portal link, got %s", message.HTML)
+				}
+			},
+		},
+		{
+			name:           "failed payment of an organisation reminds its billing admins",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           failedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": failedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				organisation := ensureOrganisationRecord(t, app)
+
+				customer, err := app.FindFirstRecordByData("customer", "stripe_customer_id", "cus_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				customer.Set("user_id", "")
+				customer.Set("organisation_id", organisation.Id)
+				if err := app.Save(customer); err != nil {
+					t.Fatal(err)
+				}
+
+				subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+				subscription.Set("subscription_id", "sub_dunning")
+				subscription.Set("organisation_id", organisation.Id)
+				subscription.Set("status", "past_due")
+				if err := app.Save(subscription); err != nil {
+					t.Fatal(err)
+				}
+
+				member := core.NewRecord(ensureOrganisationMemberCollection(t, app))
+				member.Set("organisation_id", organisation.Id)
+				member.Set("user_id", "usertest0000000")
+				member.Set("role", organisationRoleBillingAdmin)
+				if err := app.Save(member); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 1 {
+					t.Fatalf("Expected 1 reminder email, got %d", app.TestMailer.TotalSend())
+				}
+				if message := app.TestMailer.LastMessage(); message.To[0].Address != "test@example.com" {
+					t.Fatalf("Expected the billing admin to get the reminder, got %s", message.To[0].Address)
+				}
+			},
+		},
+		{
+			name:           "already counted payment failure doesn't send another reminder",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           failedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": failedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				saveDunning(t, app, "in_dunning", 1)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected no reminder email, got %d", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "failed payment of a new invoice counts its own attempts",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           failedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": failedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				// the previous invoice failed three times and was voided
+				saveDunning(t, app, "in_voided", 3)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("dunning", "subscription_id", "sub_dunning")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("invoice_id") != "in_dunning" || record.GetInt("attempts") != 1 {
+					t.Fatalf("Expected 1 attempt of in_dunning, got %d of %s", record.GetInt("attempts"), record.GetString("invoice_id"))
+				}
+				if app.TestMailer.TotalSend() != 1 {
+					t.Fatalf("Expected 1 reminder email, got %d", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "reminder of an attempt is only sent once when dunning restarts",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           failedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": failedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				saveSentReminder(t, app, "payment_failed:in_dunning:1")
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("dunning", "subscription_id", "sub_dunning")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetInt("attempts") != 1 {
+					t.Fatalf("Expected the failure to be counted, got %d attempts", record.GetInt("attempts"))
+				}
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected no second reminder email, got %d", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "paid invoice resolves dunning",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           paidBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": paidHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				saveDunning(t, app, "in_dunning", 1)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("dunning", "subscription_id", "sub_dunning")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != dunningStatusResolved {
+					t.Fatalf("Expected dunning status to be resolved, got %s", record.GetString("status"))
+				}
+			},
+		},
+	})
+}
+
+func TestRevokeExpiredDunning(t *testing.T) {
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Cleanup()
+
+	setupStripeMock(t)
+	collection := ensureDunningCollection(t, app)
+
+	for subscriptionID, graceEndsAt := range map[string]time.Time{
+		"sub_dunning": time.Now().Add(-time.Hour),
+		"sub_grace":   time.Now().Add(time.Hour),
+	} {
+		record := core.NewRecord(collection)
+		record.Set("subscription_id", subscriptionID)
+		record.Set("status", dunningStatusOpen)
+		record.Set("grace_ends_at", graceEndsAt.UTC().Format(time.RFC3339))
+		if err := app.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revoked, err := revokeExpiredDunning(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked != 1 {
+		t.Fatalf("Expected 1 revoked subscription, got %d", revoked)
+	}
+
+	expired, err := app.FindFirstRecordByData("dunning", "subscription_id", "sub_dunning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.GetString("status") != dunningStatusRevoked {
+		t.Fatalf("Expected expired dunning to be revoked, got %s", expired.GetString("status"))
+	}
+
+	inGrace, err := app.FindFirstRecordByData("dunning", "subscription_id", "sub_grace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inGrace.GetString("status") != dunningStatusOpen {
+		t.Fatalf("Expected dunning within the grace period to stay open, got %s", inGrace.GetString("status"))
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/mailer"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// defaultEmailTemplates are used for every email template that isn't
+// overridden in STRIPE_EMAIL_TEMPLATES_DIR.
+//
+//go:embed templates/emails/*.html
+var defaultEmailTemplates embed.FS
+
+// zeroDecimalCurrencies are the currencies Stripe charges in whole units.
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true,
+	"krw": true, "mga": true, "pyg": true, "rwf": true, "ugx": true, "vnd": true,
+	"vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+// formatAmount formats an amount in the smallest currency unit for emails,
+// e.g. 1000 usd becomes "10.00 USD".
+func formatAmount(amount int64, currency string) string {
+	currency = strings.ToLower(currency)
+	if zeroDecimalCurrencies[currency] {
+		return fmt.Sprintf("%d %s", amount, strings.ToUpper(currency))
+	}
+	return fmt.Sprintf("%.2f %s", float64(amount)/100, strings.ToUpper(currency))
+}
+
+// formatEmailDate formats a date for emails.
+func formatEmailDate(date time.Time) string {
+	return date.Format("January 2, 2006")
+}
+
+// renderEmailTemplate renders the "subject" and "body" blocks of the named
+// email template. A file with the same name in STRIPE_EMAIL_TEMPLATES_DIR
+// takes precedence over the built-in template.
+func renderEmailTemplate(name string, data map[string]any) (string, string, error) {
+	fileName := name + ".html"
+
+	var tmpl *template.Template
+	var err error
+	overridePath := filepath.Join(stripeEmailTemplatesDir, fileName)
+	if _, statErr := os.Stat(overridePath); statErr == nil {
+		tmpl, err = template.ParseFiles(overridePath)
+	} else {
+		tmpl, err = template.ParseFS(defaultEmailTemplates, "templates/emails/"+fileName)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse email template %s: %w", name, err)
+	}
+
+	var subject, body bytes.Buffer
+	if err = tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return "", "", fmt.Errorf("could not render subject of email template %s: %w", name, err)
+	}
+	if err = tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return "", "", fmt.Errorf("could not render body of email template %s: %w", name, err)
+	}
+
+	return strings.TrimSpace(subject.String()), strings.TrimSpace(body.String()), nil
+}
+
+// sendTemplatedEmail renders the named email template and sends it through
+// the app mailer to the billing owner: the user, or every billing admin of
+// the organisation. The recipient's user record is available to the template
+// as "user", and the organisation record as "organisation".
+func sendTemplatedEmail(app core.App, owner *billingOwner, name string, data map[string]any) error {
+	recipients, err := owner.emailRecipients(app)
+	if err != nil {
+		return fmt.Errorf("could not find the email recipients of %s %q: %w", owner.field(), owner.id(), err)
+	}
+	if owner.organisation != nil {
+		data["organisation"] = owner.organisation.PublicExport()
+	}
+
+	sent := 0
+	for _, user := range recipients {
+		if user.GetString("email") == "" {
+			continue
+		}
+		data["user"] = user.PublicExport()
+
+		subject, body, err := renderEmailTemplate(name, data)
+		if err != nil {
+			return err
+		}
+
+		message := &mailer.Message{
+			From: mail.Address{
+				Address: app.Settings().Meta.SenderAddress,
+				Name:    app.Settings().Meta.SenderName,
+			},
+			To:      []mail.Address{{Address: user.GetString("email")}},
+			Subject: subject,
+			HTML:    body,
+		}
+		if err = app.NewMailClient().Send(message); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return fmt.Errorf("could not find an email of %s %q", owner.field(), owner.id())
+	}
+	return nil
+}
+
+// sendReminderOnce sends the owner the named email template, unless a
+// reminder with the same key was already sent, and records it in the
+// sent_reminder collection. The key names what the reminder is about, e.g. a
+// subscription and its period, so redelivered and replayed events don't send
+// it twice. buildData is only called when the reminder is sent.
+func sendReminderOnce(app core.App, key string, owner *billingOwner, name string, buildData func() (map[string]any, error)) error {
+	if _, err := app.FindFirstRecordByData("sent_reminder", "key", key); err == nil {
+		app.Logger().Info("skipping reminder that was already sent", "key", key)
+		return nil
+	}
+
+	collection, err := app.FindCollectionByNameOrId("sent_reminder")
+	if err != nil {
+		return fmt.Errorf("could not find collection sent_reminder: %w", err)
+	}
+
+	data, err := buildData()
+	if err != nil {
+		return err
+	}
+	if err = sendTemplatedEmail(app, owner, name, data); err != nil {
+		return err
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("key", key)
+	record.Set(owner.field(), owner.id())
+	record.Set("template", name)
+	record.Set("sent_at", types.NowDateTime())
+	if err = app.Save(record); err != nil {
+		return fmt.Errorf("could not record sent reminder %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// subscriptionOwner returns the billing owner of a stored subscription.
+func subscriptionOwner(app core.App, subscriptionRecord *core.Record) (*billingOwner, error) {
+	owner, err := findBillingOwner(app, subscriptionRecord.GetString("user_id"), subscriptionRecord.GetString("organisation_id"))
+	if err != nil {
+		return nil, fmt.Errorf("could not find the billing owner of subscription %s: %w", subscriptionRecord.GetString("subscription_id"), err)
+	}
+	return owner, nil
+}
+
+// subscriptionEmailData collects the template data of a subscription: the
+// subscription and its price records, the price formatted as "amount", the
+// trial and period end dates and a billing portal link of the owner.
+func subscriptionEmailData(app core.App, owner *billingOwner, subscriptionRecord *core.Record) map[string]any {
+	data := map[string]any{
+		"subscription": subscriptionRecord.PublicExport(),
+	}
+
+	if trialEnd := subscriptionRecord.GetDateTime("trial_end"); !trialEnd.IsZero() {
+		data["trial_end"] = formatEmailDate(trialEnd.Time())
+	}
+	if periodEnd := subscriptionRecord.GetDateTime("current_period_end"); !periodEnd.IsZero() {
+		data["current_period_end"] = formatEmailDate(periodEnd.Time())
+	}
+
+	if price, err := app.FindFirstRecordByData("price", "price_id", subscriptionRecord.GetString("price_id")); err == nil {
+		data["price"] = price.PublicExport()
+		quantity := int64(subscriptionRecord.GetInt("quantity"))
+		if quantity < 1 {
+			quantity = 1
+		}
+		data["amount"] = formatAmount(int64(price.GetInt("unit_amount"))*quantity, price.GetString("currency"))
+	}
+
+	// the link is a convenience, so the email is sent without it when it fails
+	if existingCustomer, err := app.FindFirstRecordByData("customer", owner.field(), owner.id()); err == nil {
+		portal, err := newBillingPortalSession(existingCustomer.GetString("stripe_customer_id"))
+		if err != nil {
+			app.Logger().Error("could not create billing portal session for email", "error", err)
+		} else {
+			data["portal_url"] = portal.URL
+		}
+	}
+
+	return data
+}
+
+// sendTrialEndingReminder emails the owner of a subscription that its trial
+// is about to end, once per trial.
+func sendTrialEndingReminder(app core.App, subscriptionRecord *core.Record) error {
+	owner, err := subscriptionOwner(app, subscriptionRecord)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("trial_will_end:%s:%d", subscriptionRecord.GetString("subscription_id"), subscriptionRecord.GetDateTime("trial_end").Time().Unix())
+	return sendReminderOnce(app, key, owner, "trial_will_end", func() (map[string]any, error) {
+		return subscriptionEmailData(app, owner, subscriptionRecord), nil
+	})
+}
+
+// sendRenewalReminder emails the owner of the subscription an upcoming invoice
+// belongs to that the subscription is about to renew, once per renewal.
+func sendRenewalReminder(app core.App, invoice *stripe.Invoice) error {
+	if invoice.Subscription == nil {
+		return nil
+	}
+
+	subscriptionRecord, err := app.FindFirstRecordByData("subscription", "subscription_id", invoice.Subscription.ID)
+	if err != nil {
+		return fmt.Errorf("could not find subscription %s: %w", invoice.Subscription.ID, err)
+	}
+	owner, err := subscriptionOwner(app, subscriptionRecord)
+	if err != nil {
+		return err
+	}
+
+	renewalDate := invoice.NextPaymentAttempt
+	if renewalDate == 0 {
+		renewalDate = invoice.PeriodEnd
+	}
+
+	key := fmt.Sprintf("invoice_upcoming:%s:%d", invoice.Subscription.ID, renewalDate)
+	return sendReminderOnce(app, key, owner, "invoice_upcoming", func() (map[string]any, error) {
+		data := subscriptionEmailData(app, owner, subscriptionRecord)
+		data["amount"] = formatAmount(invoice.AmountDue, string(invoice.Currency))
+		data["renewal_date"] = formatEmailDate(time.Unix(renewalDate, 0))
+		return data, nil
+	})
+}
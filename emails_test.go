@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func ensureSentReminderCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("sent_reminder")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("sent_reminder")
+	collection.Fields.Add(
+		&core.TextField{Name: "key", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "organisation_id"},
+		&core.TextField{Name: "template"},
+		&core.DateField{Name: "sent_at"},
+	)
+	collection.AddIndex("idx_sent_reminder_key", true, "key", "")
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+// saveSentReminder records the reminder with key as already sent.
+func saveSentReminder(t testing.TB, app *tests.TestApp, key string) {
+	t.Helper()
+
+	record := core.NewRecord(ensureSentReminderCollection(t, app))
+	record.Set("key", key)
+	if err := app.Save(record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReminderEmails(t *testing.T) {
+	signedEvent := func(eventID string, eventType string, object string) (string, string) {
+		payload := []byte(fmt.Sprintf(`{"id":"%s","object":"event","api_version":"%s","created":1700000000,"type":"%s","data":{"object":%s}}`, eventID, stripe.APIVersion, eventType, object))
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+			Payload: payload,
+			Secret:  "whsec_test",
+		})
+		return string(payload), signed.Header
+	}
+
+	trialBody, trialHeader := signedEvent("evt_trial_will_end", "customer.subscription.trial_will_end", `{"id":"sub_trial","object":"subscription","customer":"cus_test","status":"trialing","trial_end":1700259200,"items":{"object":"list","data":[{"id":"si_trial","object":"subscription_item","quantity":2,"price":{"id":"price_test","object":"price"}}]}}`)
+	upcomingBody, upcomingHeader := signedEvent("evt_invoice_upcoming", "invoice.upcoming", `{"object":"invoice","customer":"cus_test","subscription":"sub_trial","currency":"usd","amount_due":2500,"next_payment_attempt":1700259200}`)
+
+	setup := func(t testing.TB, app *tests.TestApp) {
+		WHSEC = "whsec_test"
+		setupStripeMock(t)
+		ensureStripeEventCollection(t, app)
+		ensureSentReminderCollection(t, app)
+		user := ensureUserRecord(t, app)
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", user.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		price := core.NewRecord(ensurePriceCollection(t, app))
+		price.Set("price_id", "price_test")
+		price.Set("description", "Pro")
+		price.Set("currency", "usd")
+		price.Set("unit_amount", 1000)
+		price.Set("interval", "month")
+		if err := app.Save(price); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_trial")
+		subscription.Set("user_id", user.Id)
+		subscription.Set("price_id", "price_test")
+		subscription.Set("quantity", 2)
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// organisationSetup moves the customer and subscription of setup to an
+	// organisation, whose billing admin is the test user
+	organisationSetup := func(t testing.TB, app *tests.TestApp) {
+		setup(t, app)
+		organisation := ensureOrganisationRecord(t, app)
+		for _, collection := range []string{"customer", "subscription"} {
+			record, err := app.FindFirstRecordByData(collection, "user_id", "usertest0000000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			record.Set("user_id", "")
+			record.Set("organisation_id", organisation.Id)
+			if err := app.Save(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		members := ensureOrganisationMemberCollection(t, app)
+		for userID, role := range map[string]string{"usertest0000000": organisationRoleBillingAdmin, "memberone": organisationRoleMember} {
+			member := core.NewRecord(members)
+			member.Set("organisation_id", organisation.Id)
+			member.Set("user_id", userID)
+			member.Set("role", role)
+			if err := app.Save(member); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "trial will end sends a reminder",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           trialBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": trialHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 1 {
+					t.Fatalf("Expected 1 reminder email, got %d", app.TestMailer.TotalSend())
+				}
+				message := app.TestMailer.LastMessage()
+				if message.Subject != "Your trial ends on November 17, 2023" {
+					t.Fatalf("Unexpected subject %q", message.Subject)
+				}
+				for _, expected := range []string{"of Pro", "20.00 USD per month", "https://example.com/portal"} {
+					if !strings.Contains(message.HTML, expected) {
+						t.Fatalf("Expected reminder to contain %q, got %s", expected, message.HTML)
+					}
+				}
+				if _, err := app.FindFirstRecordByData("sent_reminder", "key", "trial_will_end:sub_trial:1700259200"); err != nil {
+					t.Fatal("Expected the reminder to be recorded as sent")
+				}
+			},
+		},
+		{
+			name:           "trial ending reminder is only sent once per trial",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           trialBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": trialHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				saveSentReminder(t, app, "trial_will_end:sub_trial:1700259200")
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected no second reminder email, got %d", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "trial will end sends no reminder when the event fails",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           trialBody,
+			expectedStatus: http.StatusInternalServerError,
+			expectedContent: []string{
+				`"failure":"could not process stripe event"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": trialHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				// the ledger record can't be marked as processed, which rolls
+				// back the event's transaction
+				app.OnRecordUpdate("stripe_event").BindFunc(func(e *core.RecordEvent) error {
+					return errors.New("ledger unavailable")
+				})
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected no reminder email for a rolled back event, got %d", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "upcoming invoice sends a renewal reminder",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           upcomingBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": upcomingHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 1 {
+					t.Fatalf("Expected 1 reminder email, got %d", app.TestMailer.TotalSend())
+				}
+				message := app.TestMailer.LastMessage()
+				if message.Subject != "Your subscription renews on November 17, 2023" {
+					t.Fatalf("Unexpected subject %q", message.Subject)
+				}
+				if !strings.Contains(message.HTML, "charged 25.00 USD") {
+					t.Fatalf("Expected reminder to contain the invoice amount, got %s", message.HTML)
+				}
+			},
+		},
+		{
+			name:           "renewal reminder of an organisation goes to its billing admins",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           upcomingBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": upcomingHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				organisationSetup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 1 {
+					t.Fatalf("Expected 1 reminder email, got %d", app.TestMailer.TotalSend())
+				}
+				message := app.TestMailer.LastMessage()
+				if message.To[0].Address != "test@example.com" || !strings.Contains(message.HTML, "https://example.com/portal") {
+					t.Fatalf("Expected the billing admin to get a reminder with the portal link, got %v", message)
+				}
+				record, err := app.FindFirstRecordByData("sent_reminder", "key", "invoice_upcoming:sub_trial:1700259200")
+				if err != nil || record.GetString("organisation_id") != "orgtest00000000" {
+					t.Fatalf("Expected the reminder to be recorded for the organisation, got %v", record)
+				}
+			},
+		},
+		{
+			name:           "renewal reminder is only sent once per renewal",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           upcomingBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": upcomingHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				saveSentReminder(t, app, "invoice_upcoming:sub_trial:1700259200")
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected no second reminder email, got %d", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "email templates can be overridden",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           upcomingBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": upcomingHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+
+				dir := t.TempDir()
+				override := `{{define "subject"}}Renewal for {{.user.email}}{{end}}{{define "body"}}<p>{{.amount}}</p>{{end}}`
+				if err := os.WriteFile(filepath.Join(dir, "invoice_upcoming.html"), []byte(override), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				stripeEmailTemplatesDir = dir
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				defer func() { stripeEmailTemplatesDir = "templates/emails" }()
+
+				message := app.TestMailer.LastMessage()
+				if message.Subject != "Renewal for test@example.com" {
+					t.Fatalf("Unexpected subject %q", message.Subject)
+				}
+				if message.HTML != "<p>25.00 USD</p>" {
+					t.Fatalf("Unexpected body %q", message.HTML)
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/stripe/stripe-go/v76"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+const (
+	stripeEventStatusPending    = "pending"
+	stripeEventStatusProcessed  = "processed"
+	stripeEventStatusFailed     = "failed"
+	stripeEventStatusDeadLetter = "dead_letter"
+	stripeEventStatusIgnored    = "ignored"
+)
+
+// the retry delay stops doubling after maxStripeEventRetryExponent attempts
+// and never exceeds maxStripeEventRetryDelay
+const (
+	maxStripeEventRetryExponent = 20
+	maxStripeEventRetryDelay    = 24 * time.Hour
+)
+
+// errUnhandledStripeEvent is returned by syncStripeEvent for event types it
+// doesn't know how to mirror.
+var errUnhandledStripeEvent = errors.New("unhandled stripe event type")
+
+// stripeEventError carries the HTTP status and failure message that is
+// reported back to Stripe when an event could not be synced.
+type stripeEventError struct {
+	status  int
+	failure string
+	err     error
+}
+
+func newStripeEventError(status int, failure string, err error) *stripeEventError {
+	return &stripeEventError{status: status, failure: failure, err: err}
+}
+
+func (e *stripeEventError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%s: %v", e.failure, e.err)
+	}
+	return e.failure
+}
+
+func (e *stripeEventError) Unwrap() error {
+	return e.err
+}
+
+// stripeEventSync carries what syncing an event needs besides the database:
+// the Stripe objects that aren't part of the event payload, which are read
+// before the event's transaction is opened, and the side effects of the
+// event, like emails and changes in Stripe. The side effects can't be rolled
+// back with the database changes, so they only run once the event's
+// transaction is committed.
+type stripeEventSync struct {
+	// lineItems are the line items of a payment mode checkout session
+	lineItems []orderLineItem
+	// disputedCharge is the charge of a dispute
+	disputedCharge *stripe.Charge
+	// checkoutSubscription is the subscription of a subscription mode
+	// checkout session whose payload only holds its ID
+	checkoutSubscription *stripe.Subscription
+
+	effects []func(app core.App) error
+}
+
+// fetchStripeEventData reads the Stripe objects syncing the event needs that
+// aren't part of its payload, so the event's transaction doesn't wait on the
+// Stripe API.
+func fetchStripeEventData(app core.App, event stripe.Event) (*stripeEventSync, error) {
+	eventSync := &stripeEventSync{}
+
+	switch event.Type {
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded", "checkout.session.async_payment_failed":
+		var checkoutSesh stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &checkoutSesh); err != nil {
+			app.Logger().Error("failed to unmarshall the stripe checkout session event", "error", err)
+			return nil, newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
+		}
+
+		if checkoutSesh.Mode == stripe.CheckoutSessionModePayment {
+			lineItems, err := checkoutSessionLineItems(&checkoutSesh)
+			if err != nil {
+				app.Logger().Error("could not list checkout session line items", "sessionId", checkoutSesh.ID, "error", err)
+				return nil, newStripeEventError(http.StatusInternalServerError, "could not list checkout line items", err)
+			}
+			eventSync.lineItems = lineItems
+		}
+
+		// a failed payment only needs the subscription ID
+		unexpanded := checkoutSesh.Subscription != nil && checkoutSesh.Subscription.Items == nil
+		if checkoutSesh.Mode == stripe.CheckoutSessionModeSubscription && unexpanded && event.Type != "checkout.session.async_payment_failed" {
+			subscription, err := stripeSubscription.Get(checkoutSesh.Subscription.ID, nil)
+			if err != nil {
+				app.Logger().Error("could not get checkout session subscription", "subscriptionId", checkoutSesh.Subscription.ID, "error", err)
+				return nil, newStripeEventError(http.StatusInternalServerError, "could not get checkout subscription", err)
+			}
+			eventSync.checkoutSubscription = subscription
+		}
+
+	case "charge.dispute.created", "charge.dispute.closed":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			app.Logger().Error("failed to unmarshall the stripe dispute event", "error", err)
+			return nil, newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
+		}
+
+		charge, err := fetchDisputedCharge(app, &dispute)
+		if err != nil {
+			return nil, err
+		}
+		eventSync.disputedCharge = charge
+	}
+
+	return eventSync, nil
+}
+
+// after schedules effect to run once the event's transaction is committed.
+// It gets the app outside of the transaction.
+func (s *stripeEventSync) after(effect func(app core.App) error) {
+	s.effects = append(s.effects, effect)
+}
+
+// runEffects runs the scheduled side effects in order. The event is already
+// synced, so a failing side effect is logged and doesn't fail the event.
+func (s *stripeEventSync) runEffects(app core.App, event stripe.Event) {
+	for _, effect := range s.effects {
+		if err := effect(app); err != nil {
+			app.Logger().Error("could not run stripe event side effect", "eventId", event.ID, "type", event.Type, "error", err)
+		}
+	}
+}
+
+// isStaleStripeEvent reports whether the record was already synced from an
+// event created after eventCreated. Stripe doesn't guarantee delivery order,
+// so a late event must not overwrite newer state.
+func isStaleStripeEvent(record *core.Record, eventCreated int64) bool {
+	lastEventCreated := record.GetDateTime("last_event_created")
+	return !lastEventCreated.IsZero() && lastEventCreated.Time().Unix() > eventCreated
+}
+
+// recordStripeEvent returns the stripe_event ledger record for the event,
+// creating a pending one on its first delivery.
+func recordStripeEvent(app core.App, event stripe.Event, payload []byte) (*core.Record, error) {
+	existingRecord, err := app.FindFirstRecordByData("stripe_event", "event_id", event.ID)
+	if err == nil && existingRecord != nil {
+		return existingRecord, nil
+	}
+
+	collection, err := app.FindCollectionByNameOrId("stripe_event")
+	if err != nil {
+		return nil, err
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("event_id", event.ID)
+	record.Set("type", string(event.Type))
+	record.Set("event_created", int64ToISODate(event.Created))
+	record.Set("status", stripeEventStatusPending)
+	record.Set("attempts", 0)
+	record.Set("next_attempt_at", types.NowDateTime())
+	record.Set("payload", types.JSONRaw(payload))
+
+	if err = app.Save(record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// processStripeEvent syncs the event and marks its ledger record as processed
+// in the same transaction, so the database changes are applied exactly once.
+// The transaction only writes to the database: the Stripe objects the event
+// needs are fetched before it and the side effects of the event run after it
+// is committed, unless syncOnly is set. Failures are recorded on the ledger
+// record and returned to the caller.
+func processStripeEvent(app core.App, record *core.Record, event stripe.Event, syncOnly bool) error {
+	if !isStripeEventAllowed(string(event.Type)) {
+		app.Logger().Info("ignoring stripe event outside of the allowlist", "eventId", event.ID, "type", event.Type)
+		return markStripeEventIgnored(app, record)
+	}
+
+	record.Set("attempts", record.GetInt("attempts")+1)
+
+	eventSync, err := fetchStripeEventData(app, event)
+	if err == nil {
+		err = app.RunInTransaction(func(txApp core.App) error {
+			if err := syncStripeEvent(txApp, event, eventSync); err != nil {
+				return err
+			}
+
+			record.Set("status", stripeEventStatusProcessed)
+			record.Set("error", "")
+			record.Set("processed_at", time.Now().UTC().Format(time.RFC3339))
+
+			return txApp.Save(record)
+		})
+	}
+	if err == nil {
+		if !syncOnly {
+			eventSync.runEffects(app, event)
+		}
+		return nil
+	}
+
+	if errors.Is(err, errUnhandledStripeEvent) {
+		app.Logger().Info("ignoring unhandled stripe event", "eventId", event.ID, "type", event.Type)
+		return markStripeEventIgnored(app, record)
+	}
+
+	app.Logger().Error("could not process stripe event", "eventId", event.ID, "type", event.Type, "error", err)
+	recordStripeEventFailure(app, record, err)
+
+	return err
+}
+
+// isStripeEventAllowed reports whether the event type is in the
+// STRIPE_EVENT_ALLOWLIST. An empty allowlist allows every type.
+func isStripeEventAllowed(eventType string) bool {
+	if len(stripeEventAllowlist) == 0 {
+		return true
+	}
+
+	for _, allowed := range stripeEventAllowlist {
+		if allowed == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markStripeEventIgnored records that the event was received but
+// deliberately not synced.
+func markStripeEventIgnored(app core.App, record *core.Record) error {
+	record.Set("status", stripeEventStatusIgnored)
+	record.Set("error", "")
+	record.Set("next_attempt_at", "")
+	record.Set("processed_at", time.Now().UTC().Format(time.RFC3339))
+
+	return app.Save(record)
+}
+
+// recordStripeEventFailure stores the error on the ledger record and schedules
+// the next attempt with exponential backoff. Once the event has used up all of
+// its attempts it is copied to the dead-letter collection instead.
+func recordStripeEventFailure(app core.App, record *core.Record, err error) {
+	attempts := record.GetInt("attempts")
+
+	// the rolled back transaction may have marked the record as processed
+	record.Set("processed_at", "")
+	record.Set("error", err.Error())
+	if attempts >= stripeWebhookMaxAttempts {
+		record.Set("status", stripeEventStatusDeadLetter)
+		record.Set("next_attempt_at", "")
+
+		if deadLetterErr := saveStripeDeadLetter(app, record); deadLetterErr != nil {
+			app.Logger().Error("could not save stripe dead letter record", "eventId", record.GetString("event_id"), "error", deadLetterErr)
+		}
+	} else {
+		backoff := stripeEventRetryDelay(attempts)
+		record.Set("status", stripeEventStatusFailed)
+		record.Set("next_attempt_at", time.Now().UTC().Add(backoff).Format(time.RFC3339))
+	}
+
+	if saveErr := app.Save(record); saveErr != nil {
+		app.Logger().Error("could not save stripe event record", "eventId", record.GetString("event_id"), "error", saveErr)
+	}
+}
+
+// stripeEventRetryDelay returns how long to wait before the next attempt of
+// an event that failed attempts times: STRIPE_WEBHOOK_RETRY_DELAY, doubled on
+// every further attempt up to maxStripeEventRetryDelay.
+func stripeEventRetryDelay(attempts int) time.Duration {
+	// the exponent is capped so the shift can't overflow
+	exponent := min(max(attempts-1, 0), maxStripeEventRetryExponent)
+	backoff := stripeWebhookRetryDelay * time.Duration(1<<exponent)
+	if backoff <= 0 || backoff > maxStripeEventRetryDelay {
+		return maxStripeEventRetryDelay
+	}
+	return backoff
+}
+
+// saveStripeDeadLetter copies a permanently failing event into the
+// stripe_event_dead_letter collection.
+func saveStripeDeadLetter(app core.App, record *core.Record) error {
+	collection, err := app.FindCollectionByNameOrId("stripe_event_dead_letter")
+	if err != nil {
+		return err
+	}
+
+	deadLetter, err := app.FindFirstRecordByData("stripe_event_dead_letter", "event_id", record.GetString("event_id"))
+	if err != nil || deadLetter == nil {
+		deadLetter = core.NewRecord(collection)
+	}
+
+	deadLetter.Set("event_id", record.GetString("event_id"))
+	deadLetter.Set("type", record.GetString("type"))
+	deadLetter.Set("payload", record.Get("payload"))
+	deadLetter.Set("error", record.GetString("error"))
+	deadLetter.Set("attempts", record.GetInt("attempts"))
+	deadLetter.Set("failed_at", types.NowDateTime())
+
+	return app.Save(deadLetter)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// upsertInvoice mirrors a Stripe invoice into the invoice collection, linking
+// it to the user through the customer mapping table, so billing history can
+// be shown without calling Stripe. See upsertSubscription for the meaning of
+// syncedAt. It returns a nil record when the stored invoice is newer and the
+// update was skipped.
+func upsertInvoice(app core.App, invoice *stripe.Invoice, syncedAt int64) (*core.Record, error) {
+	if invoice.Customer == nil {
+		app.Logger().Error("invoice missing customer", "invoiceId", invoice.ID)
+		return nil, newStripeEventError(http.StatusBadRequest, "missing invoice customer", nil)
+	}
+
+	existingCustomer, err := app.FindFirstRecordByData("customer", "stripe_customer_id", invoice.Customer.ID)
+	if err != nil {
+		app.Logger().Error("could not find customer record for invoice", "invoiceId", invoice.ID, "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "no customer", err)
+	}
+
+	collection, err := app.FindCollectionByNameOrId("invoice")
+	if err != nil {
+		app.Logger().Error("could not find collection invoice", "error", err)
+		return nil, newStripeEventError(http.StatusInternalServerError, "could not find collection invoice", err)
+	}
+
+	existingRecord, err := app.FindFirstRecordByData("invoice", "invoice_id", invoice.ID)
+	var recordToSave *core.Record
+
+	if err == nil && existingRecord != nil {
+		recordToSave = existingRecord
+	} else {
+		recordToSave = core.NewRecord(collection)
+	}
+
+	if isStaleStripeEvent(recordToSave, syncedAt) {
+		app.Logger().Info("skipping stale invoice update", "invoiceId", invoice.ID)
+		return nil, nil
+	}
+
+	recordToSave.Set("invoice_id", invoice.ID)
+	recordToSave.Set("user_id", existingCustomer.GetString("user_id"))
+	recordToSave.Set("organisation_id", existingCustomer.GetString("organisation_id"))
+	recordToSave.Set("stripe_customer_id", invoice.Customer.ID)
+	if invoice.Subscription != nil {
+		recordToSave.Set("subscription_id", invoice.Subscription.ID)
+	}
+	recordToSave.Set("number", invoice.Number)
+	recordToSave.Set("status", invoice.Status)
+	recordToSave.Set("billing_reason", invoice.BillingReason)
+	recordToSave.Set("currency", invoice.Currency)
+	recordToSave.Set("subtotal", invoice.Subtotal)
+	recordToSave.Set("total", invoice.Total)
+	recordToSave.Set("amount_due", invoice.AmountDue)
+	recordToSave.Set("amount_paid", invoice.AmountPaid)
+	recordToSave.Set("amount_remaining", invoice.AmountRemaining)
+	recordToSave.Set("attempt_count", invoice.AttemptCount)
+	recordToSave.Set("hosted_invoice_url", invoice.HostedInvoiceURL)
+	recordToSave.Set("invoice_pdf", invoice.InvoicePDF)
+	recordToSave.Set("metadata", invoice.Metadata)
+	recordToSave.Set("invoice_created", int64ToISODate(invoice.Created))
+	recordToSave.Set("period_start", int64ToISODate(invoice.PeriodStart))
+	recordToSave.Set("period_end", int64ToISODate(invoice.PeriodEnd))
+	if invoice.DueDate > 0 {
+		recordToSave.Set("due_date", int64ToISODate(invoice.DueDate))
+	}
+	if invoice.StatusTransitions != nil && invoice.StatusTransitions.PaidAt > 0 {
+		recordToSave.Set("paid_at", int64ToISODate(invoice.StatusTransitions.PaidAt))
+	}
+	recordToSave.Set("last_event_created", int64ToISODate(syncedAt))
+
+	if err = app.Save(recordToSave); err != nil {
+		app.Logger().Error("could not save invoice record", "invoiceId", invoice.ID, "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "could not save invoice record", err)
+	}
+
+	return recordToSave, nil
+}
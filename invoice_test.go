@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func ensureInvoiceCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("invoice")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("invoice")
+	collection.Fields.Add(
+		&core.TextField{Name: "invoice_id", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "organisation_id"},
+		&core.TextField{Name: "stripe_customer_id"},
+		&core.TextField{Name: "subscription_id"},
+		&core.TextField{Name: "number"},
+		&core.TextField{Name: "status"},
+		&core.TextField{Name: "billing_reason"},
+		&core.TextField{Name: "currency"},
+		&core.NumberField{Name: "subtotal", OnlyInt: true},
+		&core.NumberField{Name: "total", OnlyInt: true},
+		&core.NumberField{Name: "amount_due", OnlyInt: true},
+		&core.NumberField{Name: "amount_paid", OnlyInt: true},
+		&core.NumberField{Name: "amount_remaining", OnlyInt: true},
+		&core.NumberField{Name: "attempt_count", OnlyInt: true},
+		&core.TextField{Name: "hosted_invoice_url"},
+		&core.TextField{Name: "invoice_pdf"},
+		&core.JSONField{Name: "metadata"},
+		&core.DateField{Name: "invoice_created"},
+		&core.DateField{Name: "period_start"},
+		&core.DateField{Name: "period_end"},
+		&core.DateField{Name: "due_date"},
+		&core.DateField{Name: "paid_at"},
+		&core.DateField{Name: "last_event_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func TestInvoiceEvents(t *testing.T) {
+	payloadPaid := []byte(fmt.Sprintf(`{"id":"evt_invoice_paid","object":"event","api_version":"%s","created":1700000100,"type":"invoice.paid","data":{"object":{"id":"in_test","object":"invoice","customer":"cus_test","subscription":"sub_test","number":"INV-0001","status":"paid","billing_reason":"subscription_create","currency":"usd","subtotal":1000,"total":1000,"amount_due":1000,"amount_paid":1000,"amount_remaining":0,"hosted_invoice_url":"https://example.com/invoice","invoice_pdf":"https://example.com/invoice.pdf","created":1700000000,"status_transitions":{"paid_at":1700000100}}}}`, stripe.APIVersion))
+	signedPaid := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadPaid,
+		Secret:  "whsec_test",
+	})
+
+	payloadStale := []byte(fmt.Sprintf(`{"id":"evt_invoice_created","object":"event","api_version":"%s","created":1700000000,"type":"invoice.created","data":{"object":{"id":"in_test","object":"invoice","customer":"cus_test","status":"draft","currency":"usd","amount_due":1000}}}`, stripe.APIVersion))
+	signedStale := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadStale,
+		Secret:  "whsec_test",
+	})
+
+	payloadNoCustomer := []byte(fmt.Sprintf(`{"id":"evt_invoice_orphan","object":"event","api_version":"%s","type":"invoice.finalized","data":{"object":{"id":"in_orphan","object":"invoice","status":"open"}}}`, stripe.APIVersion))
+	signedNoCustomer := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadNoCustomer,
+		Secret:  "whsec_test",
+	})
+
+	setup := func(t testing.TB, app *tests.TestApp) {
+		WHSEC = "whsec_test"
+		ensureStripeEventCollection(t, app)
+		ensureInvoiceCollection(t, app)
+		collection := ensureCustomerCollection(t, app)
+		record := core.NewRecord(collection)
+		record.Set("user_id", "user_test")
+		record.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "invoice paid creates invoice linked to the user",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadPaid),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedPaid.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("invoice", "invoice_id", "in_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("user_id") != "user_test" {
+					t.Fatalf("Expected invoice user_id to be user_test, got %s", record.GetString("user_id"))
+				}
+				if record.GetString("subscription_id") != "sub_test" {
+					t.Fatalf("Expected invoice subscription_id to be sub_test, got %s", record.GetString("subscription_id"))
+				}
+				if record.GetString("status") != "paid" {
+					t.Fatalf("Expected invoice status to be paid, got %s", record.GetString("status"))
+				}
+				if record.GetInt("amount_paid") != 1000 {
+					t.Fatalf("Expected invoice amount_paid to be 1000, got %d", record.GetInt("amount_paid"))
+				}
+				if record.GetString("invoice_pdf") != "https://example.com/invoice.pdf" {
+					t.Fatalf("Expected invoice_pdf to be stored, got %s", record.GetString("invoice_pdf"))
+				}
+				if record.GetDateTime("paid_at").IsZero() {
+					t.Fatal("Expected invoice paid_at to be set")
+				}
+			},
+		},
+		{
+			name:           "invoice of an organisation is linked to the organisation",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadPaid),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedPaid.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				record, err := app.FindFirstRecordByData("customer", "stripe_customer_id", "cus_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				record.Set("user_id", "")
+				record.Set("organisation_id", "org_test")
+				if err := app.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("invoice", "invoice_id", "in_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("organisation_id") != "org_test" || record.GetString("user_id") != "" {
+					t.Fatalf("Expected the invoice to belong to org_test, got %v", record)
+				}
+			},
+		},
+		{
+			name:           "older invoice event does not overwrite newer state",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadStale),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedStale.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				record := core.NewRecord(ensureInvoiceCollection(t, app))
+				record.Set("invoice_id", "in_test")
+				record.Set("status", "paid")
+				record.Set("last_event_created", int64ToISODate(1700000100))
+				if err := app.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("invoice", "invoice_id", "in_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "paid" {
+					t.Fatalf("Expected invoice status to stay paid, got %s", record.GetString("status"))
+				}
+			},
+		},
+		{
+			name:           "invoice without customer is rejected",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadNoCustomer),
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"missing invoice customer"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedNoCustomer.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+		},
+	})
+}
+
+// bootstrapSchemaRules returns the list and view rule of a collection in the
+// bootstrap schema.
+func bootstrapSchemaRules(t testing.TB, name string) (string, string) {
+	t.Helper()
+
+	payload, err := os.ReadFile("pb_bootstrap/pb_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var collections []struct {
+		Name     string  `json:"name"`
+		ListRule *string `json:"listRule"`
+		ViewRule *string `json:"viewRule"`
+	}
+	if err := json.Unmarshal(payload, &collections); err != nil {
+		t.Fatal(err)
+	}
+	for _, collection := range collections {
+		if collection.Name == name && collection.ListRule != nil && collection.ViewRule != nil {
+			return *collection.ListRule, *collection.ViewRule
+		}
+	}
+	t.Fatalf("Expected collection %s with list and view rules in the bootstrap schema", name)
+	return "", ""
+}
+
+func TestBillingHistoryRules(t *testing.T) {
+	collections := map[string]func(t testing.TB, app *tests.TestApp) *core.Collection{
+		"invoice":          ensureInvoiceCollection,
+		"order":            ensureOrderCollection,
+		"checkout_session": ensureCheckoutSessionCollection,
+	}
+	idFields := map[string]string{
+		"invoice":          "invoice_id",
+		"order":            "checkout_session_id",
+		"checkout_session": "checkout_session_id",
+	}
+
+	// setup stores a record of the organisation with the bootstrap rules, and
+	// makes the test user a member of the organisation when member is set
+	setup := func(name string, member bool) func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+		return func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+			members := ensureOrganisationMemberCollection(t, app)
+			collection := collections[name](t, app)
+			listRule, viewRule := bootstrapSchemaRules(t, name)
+			collection.ListRule = &listRule
+			collection.ViewRule = &viewRule
+			if err := app.Save(collection); err != nil {
+				t.Fatal(err)
+			}
+
+			record := core.NewRecord(collection)
+			record.Set(idFields[name], "billing_org")
+			record.Set("organisation_id", "orgtest00000000")
+			if err := app.Save(record); err != nil {
+				t.Fatal(err)
+			}
+
+			user, token := authTokenForTestUser(t, app)
+			if member {
+				memberRecord := core.NewRecord(members)
+				memberRecord.Set("organisation_id", "orgtest00000000")
+				memberRecord.Set("user_id", user.Id)
+				if err := app.Save(memberRecord); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			scenario.Headers = map[string]string{
+				"Authorization": token,
+			}
+		}
+	}
+
+	var scenarios []endpointScenario
+	for _, name := range []string{"invoice", "order", "checkout_session"} {
+		scenarios = append(scenarios,
+			endpointScenario{
+				name:           "organisation members list the " + name + " records of the organisation",
+				method:         http.MethodGet,
+				url:            "/api/collections/" + name + "/records",
+				expectedStatus: http.StatusOK,
+				expectedContent: []string{
+					`"totalItems":1`,
+					`"organisation_id":"orgtest00000000"`,
+				},
+				setup: setup(name, true),
+			},
+			endpointScenario{
+				name:           "outsiders don't list the " + name + " records of the organisation",
+				method:         http.MethodGet,
+				url:            "/api/collections/" + name + "/records",
+				expectedStatus: http.StatusOK,
+				expectedContent: []string{
+					`"totalItems":0`,
+				},
+				setup: setup(name, false),
+			},
+		)
+	}
+
+	runEndpointScenarios(t, scenarios)
+}
@@ -2,20 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/plugins/jsvm"
 
 	"github.com/stripe/stripe-go/v76"
 	"github.com/stripe/stripe-go/v76/billingportal/session"
 	checkoutSession "github.com/stripe/stripe-go/v76/checkout/session"
-	"github.com/stripe/stripe-go/v76/customer"
 	"github.com/stripe/stripe-go/v76/webhook"
 )
 
@@ -24,6 +28,33 @@ var (
 	stripeCancelURL        string
 	stripeBillingReturnURL string
 	WHSEC                  string
+
+	stripeWebhookWorkers     int
+	stripeWebhookMaxAttempts int
+	stripeWebhookRetryDelay  time.Duration
+
+	stripeReconcileSchedule  string
+	stripeDriftCheckSchedule string
+
+	stripeCatalogHardDelete bool
+
+	stripeCheckoutPurchasableOnly bool
+
+	stripeDuplicateSubscriptionPolicy string
+
+	stripeProrationBehavior string
+
+	stripeRetentionCoupon string
+
+	stripeEventAllowlist []string
+
+	stripePaymentMethodTypes []string
+
+	stripeRefundDisputePolicy string
+
+	stripeDunningGracePeriod time.Duration
+
+	stripeEmailTemplatesDir string
 )
 
 func init() {
@@ -31,6 +62,75 @@ func init() {
 	stripeCancelURL = os.Getenv("STRIPE_CANCEL_URL")
 	stripeBillingReturnURL = os.Getenv("STRIPE_BILLING_RETURN_URL")
 	WHSEC = os.Getenv("STRIPE_WHSEC")
+
+	stripeWebhookWorkers = envInt("STRIPE_WEBHOOK_WORKERS", 4)
+	stripeWebhookMaxAttempts = envInt("STRIPE_WEBHOOK_MAX_ATTEMPTS", 8)
+	stripeWebhookRetryDelay = envDuration("STRIPE_WEBHOOK_RETRY_DELAY", 30*time.Second)
+
+	stripeReconcileSchedule = os.Getenv("STRIPE_RECONCILE_SCHEDULE")
+	stripeDriftCheckSchedule = os.Getenv("STRIPE_DRIFT_CHECK_SCHEDULE")
+
+	stripeCatalogHardDelete = os.Getenv("STRIPE_CATALOG_HARD_DELETE") == "true"
+
+	stripeCheckoutPurchasableOnly = os.Getenv("STRIPE_CHECKOUT_PURCHASABLE_ONLY") == "true"
+
+	stripeDuplicateSubscriptionPolicy = os.Getenv("STRIPE_DUPLICATE_SUBSCRIPTION_POLICY")
+	if stripeDuplicateSubscriptionPolicy == "" {
+		stripeDuplicateSubscriptionPolicy = duplicateSubscriptionPolicyReject
+	}
+
+	stripeProrationBehavior = os.Getenv("STRIPE_PRORATION_BEHAVIOR")
+	if stripeProrationBehavior == "" {
+		stripeProrationBehavior = prorationBehaviorCreateProrations
+	}
+
+	stripeRetentionCoupon = os.Getenv("STRIPE_RETENTION_COUPON")
+
+	stripeEventAllowlist = parseCommaList(os.Getenv("STRIPE_EVENT_ALLOWLIST"))
+
+	stripePaymentMethodTypes = parseCommaList(os.Getenv("STRIPE_PAYMENT_METHOD_TYPES"))
+	if len(stripePaymentMethodTypes) == 0 {
+		stripePaymentMethodTypes = []string{"card"}
+	}
+
+	stripeRefundDisputePolicy = os.Getenv("STRIPE_REFUND_DISPUTE_POLICY")
+	if stripeRefundDisputePolicy == "" {
+		stripeRefundDisputePolicy = refundDisputePolicyFlag
+	}
+
+	stripeDunningGracePeriod = envDuration("STRIPE_DUNNING_GRACE_PERIOD", 7*24*time.Hour)
+
+	stripeEmailTemplatesDir = os.Getenv("STRIPE_EMAIL_TEMPLATES_DIR")
+	if stripeEmailTemplatesDir == "" {
+		stripeEmailTemplatesDir = "templates/emails"
+	}
+}
+
+func envInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// parseCommaList splits a comma separated list, dropping blank entries.
+func parseCommaList(value string) []string {
+	values := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+	return values
 }
 
 func coalesce(value *string, defaultValue string) string {
@@ -60,12 +160,76 @@ func main() {
 		HooksPoolSize: 25,
 	})
 
+	// register the stripe maintenance commands
+	app.RootCmd.AddCommand(newStripeCommand(app))
+
+	// keep customers owned by either a user or an organisation
+	registerCustomerOwnerHooks(app)
+
+	// keep the seats of organisation subscriptions in sync with their members
+	registerOrganisationSeatHooks(app)
+
 	// register all routes
 	app.OnServe().BindFunc(func(se *core.ServeEvent) error {
 		se.Router.GET("/goext/{name}", handleHello)
 		se.Router.POST("/create-checkout-session", handleCreateCheckoutSession)
 		se.Router.POST("/create-portal-link", handleCreatePortalLink)
+		se.Router.POST("/preview-plan-change", handlePreviewPlanChange)
+		se.Router.POST("/change-plan", handleChangePlan)
+		se.Router.POST("/cancel-subscription", handleCancelSubscription)
+		se.Router.POST("/reactivate-subscription", handleReactivateSubscription)
+		se.Router.POST("/pause-subscription", handlePauseSubscription)
+		se.Router.POST("/resume-subscription", handleResumeSubscription)
+		se.Router.POST("/retention-offer", handleRetentionOffer)
+		se.Router.POST("/accept-retention-offer", handleAcceptRetentionOffer)
 		se.Router.POST("/stripe", handleStripeWebhook)
+		se.Router.POST("/stripe/events/replay", handleReplayStripeEvents).Bind(apis.RequireSuperuserAuth())
+		se.Router.POST("/stripe/events/{id}/replay", handleReplayStripeEvent).Bind(apis.RequireSuperuserAuth())
+		se.Router.POST("/stripe/sync/catalog", handleSyncStripeCatalog).Bind(apis.RequireSuperuserAuth())
+		se.Router.POST("/stripe/sync/subscriptions", handleReconcileStripeSubscriptions).Bind(apis.RequireSuperuserAuth())
+		se.Router.POST("/stripe/drift", handleCheckSubscriptionDrift).Bind(apis.RequireSuperuserAuth())
+
+		// grant access to subscriptions synced before the access field existed
+		if updated, err := backfillSubscriptionAccess(se.App); err != nil {
+			se.App.Logger().Error("could not backfill subscription access", "error", err)
+		} else if updated > 0 {
+			se.App.Logger().Info("backfilled subscription access", "updated", updated)
+		}
+
+		// sync webhook events in the background
+		if stripeWebhookWorkers > 0 {
+			startStripeEventQueue(se.App, stripeWebhookWorkers)
+		}
+
+		// periodically repair customers and subscriptions that drifted from Stripe
+		if stripeReconcileSchedule != "" {
+			se.App.Cron().MustAdd("stripeReconcile", stripeReconcileSchedule, func() {
+				runScheduledReconciliation(se.App)
+			})
+		}
+
+		// periodically report subscriptions that disagree with Stripe
+		if stripeDriftCheckSchedule != "" {
+			se.App.Cron().MustAdd("stripeDriftCheck", stripeDriftCheckSchedule, func() {
+				if _, err := runDriftCheck(se.App); err != nil {
+					se.App.Logger().Error("could not check stripe subscription drift", "error", err)
+				}
+			})
+		}
+
+		// cancel subscriptions whose payment is still failing after the grace period
+		if stripeDunningGracePeriod > 0 {
+			se.App.Cron().MustAdd("stripeDunning", "0 * * * *", func() {
+				revoked, err := revokeExpiredDunning(se.App)
+				if err != nil {
+					se.App.Logger().Error("could not revoke expired dunning", "error", err)
+					return
+				}
+				if revoked > 0 {
+					se.App.Logger().Info("revoked subscriptions after the dunning grace period", "revoked", revoked)
+				}
+			})
+		}
 
 		return se.Next()
 	})
@@ -81,7 +245,7 @@ func handleHello(e *core.RequestEvent) error {
 }
 
 func handleCreateCheckoutSession(e *core.RequestEvent) error {
-	// 1. destructure the price and quantity from the POST body
+	// 1. destructure the line items from the POST body
 	payload, err := io.ReadAll(e.Request.Body)
 	if err != nil {
 		e.App.Logger().Error("could not read request body", "error", err)
@@ -93,256 +257,127 @@ func handleCreateCheckoutSession(e *core.RequestEvent) error {
 		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not parse request body"})
 	}
 
-	price, ok := data["price"].(map[string]interface{})
-	if !ok || price == nil {
-		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid price data"})
-	}
-	quantity, ok := data["quantity"].(float64)
-	if !ok {
-		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid quantity"})
-	}
-	priceType, ok := price["type"].(string)
-	if !ok || priceType == "" {
-		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid price type"})
-	}
-	priceID, ok := price["id"].(string)
-	if !ok || priceID == "" {
-		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid price id"})
+	items, err := parseCheckoutItems(data)
+	if err != nil {
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": err.Error()})
 	}
 
-	// 2. get the user from pocketbase auth
+	// 2. get the user from pocketbase auth, and the organisation they check out for
 	token := e.Request.Header.Get("Authorization")
 	record, err := e.App.FindAuthRecordByToken(token, core.TokenTypeAuth)
 	if err != nil {
 		e.App.Logger().Error("could not find auth record by token", "error", err)
 		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not find auth record by token"})
 	}
+	owner, err := resolveBillingOwner(e.App, record, data)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
 
-	// 3. retrieve or create the customer in Stripe
-	existingCustomerRecord, err := e.App.FindFirstRecordByData("customer", "user_id", record.Id)
+	// 3. check the prices against the catalog and derive the mode from them
+	if err = resolveCheckoutItems(e.App, items); err != nil {
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": err.Error()})
+	}
+	requestedMode, _ := data["mode"].(string)
+	mode, err := checkoutMode(items, requestedMode)
 	if err != nil {
-		// create new customer if none exists
-		customerEmail := record.GetString("email")
-		customerParams := &stripe.CustomerParams{
-			Email: &customerEmail,
-			Metadata: map[string]string{
-				"pocketbaseUUID": record.GetString("id"),
-			},
-		}
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": err.Error()})
+	}
 
-		stripeCustomer, err := customer.New(customerParams)
-		if err != nil {
-			e.App.Logger().Error("could not create customer", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create Stripe customer"})
+	// organisations subscribe with a seat per member
+	if owner.organisation != nil && mode == stripe.CheckoutSessionModeSubscription {
+		if err = applyOrganisationSeats(e.App, owner.organisation.Id, items); err != nil {
+			e.App.Logger().Error("could not count organisation seats", "organisationId", owner.organisation.Id, "error", err)
+			return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not count organisation seats"})
 		}
+	}
 
-		// upload customer to pocketbase
-		collection, err := e.App.FindCollectionByNameOrId("customer")
+	// 4. keep users and organisations from paying for two subscriptions at once
+	if mode == stripe.CheckoutSessionModeSubscription && stripeDuplicateSubscriptionPolicy != duplicateSubscriptionPolicyAllow {
+		existingSubscription, err := findBlockingSubscription(e.App, owner, items)
 		if err != nil {
-			e.App.Logger().Error("could not find collection customer", "error", err)
-			return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not find collection customer"})
-		}
-
-		newCustomerRecord := core.NewRecord(collection)
-		newCustomerRecord.Set("user_id", record.Id)
-		newCustomerRecord.Set("stripe_customer_id", stripeCustomer.ID)
-
-		if err = e.App.Save(newCustomerRecord); err != nil {
-			e.App.Logger().Error("could not save new customer record", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new customer"})
-		}
-
-		// do pricing new customer
-		if priceType == "recurring" {
-			lineParams := []*stripe.CheckoutSessionLineItemParams{
-				{
-					Price:    stripe.String(priceID),
-					Quantity: stripe.Int64(int64(quantity)),
-				},
-			}
-			customerUpdateParams := &stripe.CheckoutSessionCustomerUpdateParams{
-				Address: stripe.String("auto"),
-			}
-			subscriptionParams := &stripe.CheckoutSessionSubscriptionDataParams{
-				Metadata: map[string]string{},
-			}
-
-			sessionParams := &stripe.CheckoutSessionParams{
-				Customer:                 &stripeCustomer.ID,
-				PaymentMethodTypes:       stripe.StringSlice([]string{"card"}),
-				BillingAddressCollection: stripe.String("required"),
-				CustomerUpdate:           customerUpdateParams,
-				Mode:                     stripe.String("subscription"),
-				AllowPromotionCodes:      stripe.Bool(true),
-				SuccessURL:               &stripeSuccessURL,
-				CancelURL:                &stripeCancelURL,
-				LineItems:                lineParams,
-				SubscriptionData:         subscriptionParams,
-			}
-			sesh, err := checkoutSession.New(sessionParams)
-			if err != nil {
-				e.App.Logger().Error("could not create checkout session", "error", err)
-				return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
-			}
-			return e.JSON(http.StatusOK, sesh)
-		} else if priceType == "one_time" {
-			lineParams := []*stripe.CheckoutSessionLineItemParams{
-				{
-					Price:    stripe.String(priceID),
-					Quantity: stripe.Int64(int64(quantity)),
-				},
-			}
-			customerUpdateParams := &stripe.CheckoutSessionCustomerUpdateParams{
-				Address: stripe.String("auto"),
+			e.App.Logger().Error("could not find active subscriptions", "error", err)
+			return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not check for active subscriptions"})
+		}
+		if existingSubscription != nil {
+			existingCustomerRecord, err := e.App.FindFirstRecordByData("customer", owner.field(), owner.id())
+			if stripeDuplicateSubscriptionPolicy != duplicateSubscriptionPolicyPortal || err != nil {
+				if owner.organisation != nil {
+					return e.JSON(http.StatusConflict, map[string]string{"failure": "organisation already has an active subscription"})
+				}
+				return e.JSON(http.StatusConflict, map[string]string{"failure": "user already has an active subscription"})
 			}
 
-			sessionParams := &stripe.CheckoutSessionParams{
-				Customer:                 &stripeCustomer.ID,
-				PaymentMethodTypes:       stripe.StringSlice([]string{"card"}),
-				BillingAddressCollection: stripe.String("required"),
-				CustomerUpdate:           customerUpdateParams,
-				Mode:                     stripe.String("payment"),
-				AllowPromotionCodes:      stripe.Bool(true),
-				SuccessURL:               &stripeSuccessURL,
-				CancelURL:                &stripeCancelURL,
-				LineItems:                lineParams,
-			}
-			sesh, err := checkoutSession.New(sessionParams)
+			// send the user to change the plan of their subscription instead
+			sesh, err := newSubscriptionUpdatePortalSession(existingCustomerRecord.GetString("stripe_customer_id"), existingSubscription.GetString("subscription_id"))
 			if err != nil {
-				e.App.Logger().Error("could not create checkout session", "error", err)
+				e.App.Logger().Error("could not create billing portal session", "error", err)
 				return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
 			}
 			return e.JSON(http.StatusOK, sesh)
 		}
-
-		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
 	}
-	// Do Pricing Existing Customer
-	if priceType == "recurring" {
-		lineParams := []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(priceID),
-				Quantity: stripe.Int64(int64(quantity)),
-			},
-		}
-		customerUpdateParams := &stripe.CheckoutSessionCustomerUpdateParams{
-			Address: stripe.String("auto"),
-		}
-		subscriptionParams := &stripe.CheckoutSessionSubscriptionDataParams{
-			Metadata: map[string]string{},
-		}
 
-		sessionParams := &stripe.CheckoutSessionParams{
-			Customer:                 stripe.String(existingCustomerRecord.GetString("stripe_customer_id")),
-			PaymentMethodTypes:       stripe.StringSlice([]string{"card"}),
-			BillingAddressCollection: stripe.String("required"),
-			CustomerUpdate:           customerUpdateParams,
-			Mode:                     stripe.String("subscription"),
-			AllowPromotionCodes:      stripe.Bool(true),
-			SuccessURL:               &stripeSuccessURL,
-			CancelURL:                &stripeCancelURL,
-			LineItems:                lineParams,
-			SubscriptionData:         subscriptionParams,
-		}
-		sesh, err := checkoutSession.New(sessionParams)
-		if err != nil {
-			e.App.Logger().Error("could not create checkout session", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
-		}
-		return e.JSON(http.StatusOK, sesh)
-	} else if priceType == "one_time" {
-		lineParams := []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(priceID),
-				Quantity: stripe.Int64(int64(quantity)),
-			},
-		}
-		customerUpdateParams := &stripe.CheckoutSessionCustomerUpdateParams{
-			Address: stripe.String("auto"),
-		}
+	// 5. retrieve or create the customer in Stripe
+	stripeCustomerID, err := findOrCreateStripeCustomer(e.App, owner, record.GetString("email"))
+	if err != nil {
+		return respondRequestError(e, err)
+	}
 
-		sessionParams := &stripe.CheckoutSessionParams{
-			Customer:                 stripe.String(existingCustomerRecord.GetString("stripe_customer_id")),
-			PaymentMethodTypes:       stripe.StringSlice([]string{"card"}),
-			BillingAddressCollection: stripe.String("required"),
-			CustomerUpdate:           customerUpdateParams,
-			Mode:                     stripe.String("payment"),
-			AllowPromotionCodes:      stripe.Bool(true),
-			SuccessURL:               &stripeSuccessURL,
-			CancelURL:                &stripeCancelURL,
-			LineItems:                lineParams,
-		}
-		sesh, err := checkoutSession.New(sessionParams)
-		if err != nil {
-			e.App.Logger().Error("could not create checkout session", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
+	// 6. create the checkout session
+	customerUpdateParams := &stripe.CheckoutSessionCustomerUpdateParams{
+		Address: stripe.String("auto"),
+	}
+	sessionParams := &stripe.CheckoutSessionParams{
+		Customer:                 stripe.String(stripeCustomerID),
+		PaymentMethodTypes:       stripe.StringSlice(stripePaymentMethodTypes),
+		BillingAddressCollection: stripe.String("required"),
+		CustomerUpdate:           customerUpdateParams,
+		Mode:                     stripe.String(string(mode)),
+		AllowPromotionCodes:      stripe.Bool(true),
+		SuccessURL:               &stripeSuccessURL,
+		CancelURL:                &stripeCancelURL,
+		LineItems:                checkoutLineItemParams(items),
+	}
+	if mode == stripe.CheckoutSessionModeSubscription {
+		sessionParams.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: map[string]string{},
 		}
-		return e.JSON(http.StatusOK, sesh)
 	}
 
-	return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session for stripe"})
+	sesh, err := checkoutSession.New(sessionParams)
+	if err != nil {
+		e.App.Logger().Error("could not create checkout session", "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
+	}
+	return e.JSON(http.StatusOK, sesh)
 }
 
 func handleCreatePortalLink(e *core.RequestEvent) error {
-	// 1. get the user from pocketbase auth
+	// 1. get the user from pocketbase auth, and the organisation they manage
+	data, err := readRequestBody(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
 	token := e.Request.Header.Get("Authorization")
 	record, err := e.App.FindAuthRecordByToken(token, core.TokenTypeAuth)
 	if err != nil {
 		e.App.Logger().Error("could not find auth record by token", "error", err)
 		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not find auth record by token"})
 	}
+	owner, err := resolveBillingOwner(e.App, record, data)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
 
 	// 2. retrieve or create the customer in Stripe
-	existingCustomerRecord, err := e.App.FindFirstRecordByData("customer", "user_id", record.Id)
+	stripeCustomerID, err := findOrCreateStripeCustomer(e.App, owner, "")
 	if err != nil {
-		// create new customer if none exists
-		customerParams := &stripe.CustomerParams{
-			Metadata: map[string]string{
-				"pocketbaseUUID": record.GetString("id"),
-			},
-		}
-
-		stripeCustomer, err := customer.New(customerParams)
-		if err != nil {
-			e.App.Logger().Error("could not create customer", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create Stripe customer"})
-		}
-
-		// upload customer to pocketbase
-		collection, err := e.App.FindCollectionByNameOrId("customer")
-		if err != nil {
-			e.App.Logger().Error("could not find collection customer", "error", err)
-			return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not find collection customer"})
-		}
-
-		newCustomerRecord := core.NewRecord(collection)
-		newCustomerRecord.Set("user_id", record.Id)
-		newCustomerRecord.Set("stripe_customer_id", stripeCustomer.ID)
-
-		if err = e.App.Save(newCustomerRecord); err != nil {
-			e.App.Logger().Error("could not save new customer record", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new customer"})
-		}
-
-		// create new session
-		sessionParams := &stripe.BillingPortalSessionParams{
-			Customer:  stripe.String(stripeCustomer.ID),
-			ReturnURL: &stripeBillingReturnURL,
-		}
-		sesh, err := session.New(sessionParams)
-		if err != nil {
-			e.App.Logger().Error("could not create billing portal session", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
-		}
-		return e.JSON(http.StatusOK, sesh)
+		return respondRequestError(e, err)
 	}
 
-	// create new session for existing customer
-	sessionParams := &stripe.BillingPortalSessionParams{
-		Customer:  stripe.String(existingCustomerRecord.GetString("stripe_customer_id")),
-		ReturnURL: &stripeBillingReturnURL,
-	}
-	sesh, err := session.New(sessionParams)
+	// create new session
+	sesh, err := newBillingPortalSession(stripeCustomerID)
 	if err != nil {
 		e.App.Logger().Error("could not create billing portal session", "error", err)
 		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not create new session"})
@@ -350,6 +385,32 @@ func handleCreatePortalLink(e *core.RequestEvent) error {
 	return e.JSON(http.StatusOK, sesh)
 }
 
+// newBillingPortalSession creates a billing portal session for a Stripe
+// customer that returns to STRIPE_BILLING_RETURN_URL.
+func newBillingPortalSession(stripeCustomerID string) (*stripe.BillingPortalSession, error) {
+	sessionParams := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(stripeCustomerID),
+		ReturnURL: &stripeBillingReturnURL,
+	}
+	return session.New(sessionParams)
+}
+
+// newSubscriptionUpdatePortalSession creates a billing portal session that
+// opens straight into changing the plan of a subscription.
+func newSubscriptionUpdatePortalSession(stripeCustomerID, subscriptionID string) (*stripe.BillingPortalSession, error) {
+	sessionParams := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(stripeCustomerID),
+		ReturnURL: &stripeBillingReturnURL,
+		FlowData: &stripe.BillingPortalSessionFlowDataParams{
+			Type: stripe.String(string(stripe.BillingPortalSessionFlowTypeSubscriptionUpdate)),
+			SubscriptionUpdate: &stripe.BillingPortalSessionFlowDataSubscriptionUpdateParams{
+				Subscription: stripe.String(subscriptionID),
+			},
+		},
+	}
+	return session.New(sessionParams)
+}
+
 func handleStripeWebhook(e *core.RequestEvent) error {
 	// read the request body into a byte slice
 	payload, err := io.ReadAll(e.Request.Body)
@@ -365,253 +426,224 @@ func handleStripeWebhook(e *core.RequestEvent) error {
 		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "webhook verification failed"})
 	}
 
+	// record the delivery in the event ledger
+	eventRecord, err := recordStripeEvent(e.App, event, payload)
+	if err != nil {
+		e.App.Logger().Error("could not record stripe event", "eventId", event.ID, "error", err)
+		return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not record stripe event"})
+	}
+
+	// skip events that have already been synced or ignored
+	status := eventRecord.GetString("status")
+	if status == stripeEventStatusProcessed || status == stripeEventStatusIgnored {
+		e.App.Logger().Info("skipping already processed stripe event", "eventId", event.ID, "type", event.Type)
+		return e.JSON(http.StatusOK, map[string]interface{}{"success": "event already processed"})
+	}
+
+	// dead letters used up their attempts and are only synced again by a replay
+	if status == stripeEventStatusDeadLetter {
+		e.App.Logger().Info("skipping dead lettered stripe event", "eventId", event.ID, "type", event.Type)
+		return e.JSON(http.StatusOK, map[string]interface{}{"success": "event is dead lettered"})
+	}
+
+	// hand the event over to the background workers and acknowledge it right away
+	if stripeEventQueue != nil {
+		enqueueStripeEvent(eventRecord.Id)
+		return e.JSON(http.StatusOK, map[string]interface{}{"success": "data was received"})
+	}
+
+	// no workers are running, so sync the event inline
+	if err = processStripeEvent(e.App, eventRecord, event, false); err != nil {
+		var eventErr *stripeEventError
+		if errors.As(err, &eventErr) {
+			return e.JSON(eventErr.status, map[string]string{"failure": eventErr.failure})
+		}
+		return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not process stripe event"})
+	}
+
+	return e.JSON(http.StatusOK, map[string]interface{}{"success": "data was received"})
+}
+
+// syncStripeEvent mirrors a single Stripe event into the PocketBase collections.
+// app is the event's transaction, side effects are scheduled on eventSync.
+func syncStripeEvent(app core.App, event stripe.Event, eventSync *stripeEventSync) error {
 	switch event.Type {
 	case "product.created", "product.updated":
 		var product stripe.Product
-		err = json.Unmarshal(event.Data.Raw, &product)
+		err := json.Unmarshal(event.Data.Raw, &product)
 		if err != nil {
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "failed to marshall the stripe event"})
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
 		}
 
-		collection, err := e.App.FindCollectionByNameOrId("product")
-		if err != nil {
-			e.App.Logger().Error("Could not find collection product", "error", err)
-			return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not find collection product"})
+		if err = upsertProduct(app, &product, event.Created); err != nil {
+			return err
 		}
 
-		existingRecord, err := e.App.FindFirstRecordByData("product", "product_id", product.ID)
-		var recordToSave *core.Record
+	case "price.created", "price.updated":
+		var price stripe.Price
+		err := json.Unmarshal(event.Data.Raw, &price)
+		if err != nil {
+			app.Logger().Error("failed to unmarshall the stripe price event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
+		}
 
-		if err == nil && existingRecord != nil {
-			// existing record found, update it
-			recordToSave = existingRecord
-		} else {
-			// existing record not found, insert a new record
-			recordToSave = core.NewRecord(collection)
+		if err = upsertPrice(app, &price, event.Created); err != nil {
+			return err
 		}
 
-		recordToSave.Set("product_id", product.ID)
-		recordToSave.Set("active", product.Active)
-		recordToSave.Set("name", product.Name)
-		recordToSave.Set("description", coalesce(&product.Description, ""))
-		recordToSave.Set("metadata", product.Metadata)
+	case "product.deleted":
+		var product stripe.Product
+		err := json.Unmarshal(event.Data.Raw, &product)
+		if err != nil {
+			app.Logger().Error("failed to unmarshall the stripe product event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
+		}
 
-		if err = e.App.Save(recordToSave); err != nil {
-			e.App.Logger().Error("Could not save product record", "error", err)
+		if err = deleteCatalogRecord(app, "product", "product_id", product.ID, event.Created); err != nil {
 			return err
 		}
 
-	case "price.created", "price.updated":
+	case "price.deleted":
 		var price stripe.Price
-		err = json.Unmarshal(event.Data.Raw, &price)
+		err := json.Unmarshal(event.Data.Raw, &price)
 		if err != nil {
-			e.App.Logger().Error("failed to unmarshall the stripe price event", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "failed to marshall the stripe event"})
+			app.Logger().Error("failed to unmarshall the stripe price event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
 		}
 
-		collection, err := e.App.FindCollectionByNameOrId("price")
-		if err != nil {
-			e.App.Logger().Error("Could not find collection price", "error", err)
-			return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not find collection price"})
+		if err = deleteCatalogRecord(app, "price", "price_id", price.ID, event.Created); err != nil {
+			return err
 		}
 
-		existingRecord, err := e.App.FindFirstRecordByData("price", "price_id", price.ID)
-		var recordToSave *core.Record
-
-		if err == nil && existingRecord != nil {
-			// existing record found, update it
-			recordToSave = existingRecord
-		} else {
-			// existing record not found, insert a new record
-			recordToSave = core.NewRecord(collection)
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var subscription stripe.Subscription
+		err := json.Unmarshal(event.Data.Raw, &subscription)
+		if err != nil {
+			app.Logger().Error("failed to unmarshall the stripe subscription event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
 		}
 
-		recordToSave.Set("price_id", price.ID)
-		recordToSave.Set("product_id", price.Product.ID)
-		recordToSave.Set("active", price.Active)
-		recordToSave.Set("currency", price.Currency)
-		recordToSave.Set("description", price.Nickname)
-		recordToSave.Set("type", price.Type)
-		recordToSave.Set("unit_amount", price.UnitAmount)
-		recordToSave.Set("metadata", price.Metadata)
+		recordToSave, err := upsertSubscription(app, &subscription, event.Created)
+		if err != nil || recordToSave == nil {
+			return err
+		}
 
-		// check if recurring is not nil before accessing its fields
-		if price.Recurring != nil {
-			recordToSave.Set("interval", price.Recurring.Interval)
-			recordToSave.Set("interval_count", price.Recurring.IntervalCount)
-			recordToSave.Set("trial_period_days", price.Recurring.TrialPeriodDays)
+		if err = syncSubscriptionDunning(app, recordToSave); err != nil {
+			return err
 		}
 
-		if err = e.App.Save(recordToSave); err != nil {
-			e.App.Logger().Error("could not save price record", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not save price record"})
+		// Update User Details If Subscription Created
+		if event.Type == "customer.subscription.created" {
+			if err = updateUserPaymentDetails(app, recordToSave.GetString("user_id"), &subscription); err != nil {
+				return err
+			}
 		}
 
-	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+	case "customer.subscription.trial_will_end":
 		var subscription stripe.Subscription
-		err = json.Unmarshal(event.Data.Raw, &subscription)
+		err := json.Unmarshal(event.Data.Raw, &subscription)
 		if err != nil {
-			e.App.Logger().Error("failed to unmarshall the stripe subscription event", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "failed to marshall the stripe event"})
+			app.Logger().Error("failed to unmarshall the stripe subscription event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
 		}
 
-		// get customer's UUID from mapping table
-		if subscription.Customer == nil {
-			e.App.Logger().Error("subscription missing customer")
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "missing subscription customer"})
-		}
-		if len(subscription.Items.Data) == 0 || subscription.Items.Data[0].Price == nil {
-			e.App.Logger().Error("subscription has no items or price is nil")
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "subscription has no items"})
+		if _, err = upsertSubscription(app, &subscription, event.Created); err != nil {
+			return err
 		}
-		item := subscription.Items.Data[0]
 
-		existingCustomer, err := e.App.FindFirstRecordByData("customer", "stripe_customer_id", subscription.Customer.ID)
+		// remind the user before the trial turns into a paid subscription, using
+		// the stored subscription in case a newer event already updated it
+		subscriptionRecord, err := app.FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
 		if err != nil {
-			e.App.Logger().Error("could not find customer record for subscription", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "no customer"})
+			return newStripeEventError(http.StatusBadRequest, "could not find subscription", err)
 		}
+		eventSync.after(func(app core.App) error {
+			if err := sendTrialEndingReminder(app, subscriptionRecord); err != nil {
+				return fmt.Errorf("could not send trial ending reminder of subscription %s: %w", subscription.ID, err)
+			}
+			return nil
+		})
 
-		uuid := existingCustomer.GetString("user_id")
-		collection, err := e.App.FindCollectionByNameOrId("subscription")
+	case "invoice.created", "invoice.finalized", "invoice.paid", "invoice.payment_failed", "invoice.voided", "invoice.marked_uncollectible":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
 		if err != nil {
-			e.App.Logger().Error("could not find collection subscription", "error", err)
-			return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "collection doesn't exist"})
+			app.Logger().Error("failed to unmarshall the stripe invoice event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
 		}
 
-		// update Subscription Details
-		existingRecord, err := e.App.FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
-		var recordToSave *core.Record
-
-		if err == nil && existingRecord != nil {
-			recordToSave = existingRecord
-		} else {
-			recordToSave = core.NewRecord(collection)
+		invoiceRecord, err := upsertInvoice(app, &invoice, event.Created)
+		if err != nil || invoiceRecord == nil {
+			return err
 		}
 
-		recordToSave.Set("subscription_id", subscription.ID)
-		recordToSave.Set("user_id", uuid)
-		recordToSave.Set("metadata", subscription.Metadata)
-		recordToSave.Set("status", subscription.Status)
-		recordToSave.Set("price_id", item.Price.ID)
-		recordToSave.Set("quantity", item.Quantity)
-		recordToSave.Set("cancel_at_period_end", subscription.CancelAtPeriodEnd)
-		recordToSave.Set("cancel_at", int64ToISODate(subscription.CancelAt))
-		recordToSave.Set("canceled_at", int64ToISODate(subscription.CanceledAt))
-		recordToSave.Set("current_period_start", int64ToISODate(subscription.CurrentPeriodStart))
-		recordToSave.Set("current_period_end", int64ToISODate(subscription.CurrentPeriodEnd))
-		recordToSave.Set("created", int64ToISODate(item.Created))
-		recordToSave.Set("ended_at", int64ToISODate(subscription.EndedAt))
-		recordToSave.Set("trial_start", int64ToISODate(subscription.TrialStart))
-		recordToSave.Set("trial_end", int64ToISODate(subscription.TrialEnd))
-
-		if err = e.App.Save(recordToSave); err != nil {
-			e.App.Logger().Error("could not save subscription record", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "couldn't submit subscription update"})
+		// track failed subscription payments
+		if event.Type == "invoice.payment_failed" {
+			if err = recordDunningFailure(app, eventSync, invoiceRecord); err != nil {
+				return err
+			}
 		}
-
-		// Update User Details If Subscription Created
-		if event.Type == "customer.subscription.created" {
-			existingUserRecord, err := e.App.FindFirstRecordByData("user", "id", uuid)
-			if err == nil && existingUserRecord != nil && subscription.DefaultPaymentMethod != nil {
-				if subscription.DefaultPaymentMethod.Customer != nil {
-					existingUserRecord.Set("billing_address", subscription.DefaultPaymentMethod.Customer.Address)
-				}
-				existingUserRecord.Set("payment_method", subscription.DefaultPaymentMethod.Type)
-
-				if err := e.App.Save(existingUserRecord); err != nil {
-					e.App.Logger().Error("could not save user record", "userId", uuid, "error", err)
-					return e.JSON(http.StatusBadRequest, map[string]string{"failure": "couldn't submit user update"})
-				}
+		if event.Type == "invoice.paid" {
+			if err = closeDunning(app, invoiceRecord.GetString("subscription_id"), dunningStatusResolved); err != nil {
+				return err
 			}
 		}
 
-	case "checkout.session.completed":
-		var checkoutSesh stripe.CheckoutSession
-		err = json.Unmarshal(event.Data.Raw, &checkoutSesh)
+	case "invoice.upcoming":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
 		if err != nil {
-			e.App.Logger().Error("failed to unmarshall the stripe checkout session event", "error", err)
-			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "failed to marshall the stripe event"})
+			app.Logger().Error("failed to unmarshall the stripe invoice event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
 		}
 
-		if checkoutSesh.Mode == "subscription" {
-			if checkoutSesh.Subscription == nil {
-				e.App.Logger().Error("could not find checkout session subscription")
-				return e.JSON(http.StatusBadRequest, map[string]string{"failure": "missing checkout subscription"})
-			}
-			if checkoutSesh.Subscription.Customer == nil {
-				e.App.Logger().Error("could not find checkout session subscription customer")
-				return e.JSON(http.StatusBadRequest, map[string]string{"failure": "missing checkout customer"})
-			}
-			if len(checkoutSesh.Subscription.Items.Data) == 0 || checkoutSesh.Subscription.Items.Data[0].Price == nil {
-				e.App.Logger().Error("could not find checkout session subscription items")
-				return e.JSON(http.StatusBadRequest, map[string]string{"failure": "subscription has no items"})
-			}
-			item := checkoutSesh.Subscription.Items.Data[0]
-
-			// get customer's UUID from mapping table
-			existingCustomer, err := e.App.FindFirstRecordByData("customer", "stripe_customer_id", checkoutSesh.Subscription.Customer.ID)
-			if err != nil {
-				e.App.Logger().Error("could not find customer record for checkout session subscription", "error", err)
-				return e.JSON(http.StatusBadRequest, map[string]string{"failure": "no customer"})
+		// upcoming invoices don't exist yet, so only the reminder is sent
+		eventSync.after(func(app core.App) error {
+			if err := sendRenewalReminder(app, &invoice); err != nil {
+				return fmt.Errorf("could not send renewal reminder: %w", err)
 			}
+			return nil
+		})
 
-			uuid := existingCustomer.GetString("user_id")
-			collection, err := e.App.FindCollectionByNameOrId("subscription")
-			if err != nil {
-				e.App.Logger().Error("could not find collection subscription", "error", err)
-				return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "collection doesn't exist"})
-			}
+	case "charge.refunded":
+		var charge stripe.Charge
+		err := json.Unmarshal(event.Data.Raw, &charge)
+		if err != nil {
+			app.Logger().Error("failed to unmarshall the stripe charge event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
+		}
 
-			// update subscription details
-			existingRecord, err := e.App.FindFirstRecordByData("subscription", "subscription_id", checkoutSesh.Subscription.ID)
-			var recordToSave *core.Record
+		if err = syncChargeRefunded(app, eventSync, &charge, event.Created); err != nil {
+			return err
+		}
 
-			if err == nil && existingRecord != nil {
-				recordToSave = existingRecord
-			} else {
-				recordToSave = core.NewRecord(collection)
-			}
+	case "charge.dispute.created", "charge.dispute.closed":
+		var dispute stripe.Dispute
+		err := json.Unmarshal(event.Data.Raw, &dispute)
+		if err != nil {
+			app.Logger().Error("failed to unmarshall the stripe dispute event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
+		}
 
-			recordToSave.Set("subscription_id", checkoutSesh.Subscription.ID)
-			recordToSave.Set("user_id", uuid)
-			recordToSave.Set("metadata", checkoutSesh.Subscription.Metadata)
-			recordToSave.Set("status", checkoutSesh.Subscription.Status)
-			recordToSave.Set("price_id", item.Price.ID)
-			recordToSave.Set("quantity", item.Quantity)
-			recordToSave.Set("cancel_at_period_end", checkoutSesh.Subscription.CancelAtPeriodEnd)
-			recordToSave.Set("cancel_at", int64ToISODate(checkoutSesh.Subscription.CancelAt))
-			recordToSave.Set("canceled_at", int64ToISODate(checkoutSesh.Subscription.CanceledAt))
-			recordToSave.Set("current_period_start", int64ToISODate(checkoutSesh.Subscription.CurrentPeriodStart))
-			recordToSave.Set("current_period_end", int64ToISODate(checkoutSesh.Subscription.CurrentPeriodEnd))
-			recordToSave.Set("created", int64ToISODate(item.Created))
-			recordToSave.Set("ended_at", int64ToISODate(checkoutSesh.Subscription.EndedAt))
-			recordToSave.Set("trial_start", int64ToISODate(checkoutSesh.Subscription.TrialStart))
-			recordToSave.Set("trial_end", int64ToISODate(checkoutSesh.Subscription.TrialEnd))
-
-			if err = e.App.Save(recordToSave); err != nil {
-				e.App.Logger().Error("could not save subscription record", "error", err)
-				return e.JSON(http.StatusBadRequest, map[string]string{"failure": "couldn't submit subscription update"})
-			}
+		if err = syncDispute(app, eventSync, event.Type, &dispute, event.Created); err != nil {
+			return err
+		}
 
-			// update user details
-			existingUserRecord, err := e.App.FindFirstRecordByData("user", "id", uuid)
-			if err == nil && existingUserRecord != nil && checkoutSesh.Subscription.DefaultPaymentMethod != nil {
-				if checkoutSesh.Subscription.DefaultPaymentMethod.Customer != nil {
-					existingUserRecord.Set("billing_address", checkoutSesh.Subscription.DefaultPaymentMethod.Customer.Address)
-				}
-				existingUserRecord.Set("payment_method", checkoutSesh.Subscription.DefaultPaymentMethod.Type)
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded", "checkout.session.async_payment_failed", "checkout.session.expired":
+		var checkoutSesh stripe.CheckoutSession
+		err := json.Unmarshal(event.Data.Raw, &checkoutSesh)
+		if err != nil {
+			app.Logger().Error("failed to unmarshall the stripe checkout session event", "error", err)
+			return newStripeEventError(http.StatusBadRequest, "failed to marshall the stripe event", err)
+		}
 
-				if err = e.App.Save(existingUserRecord); err != nil {
-					e.App.Logger().Error("could not save user record after checkout session completion", "error", err)
-					return e.JSON(http.StatusBadRequest, map[string]string{"failure": "couldn't submit user update"})
-				}
-			}
+		if err = syncCheckoutSession(app, eventSync, event.Type, &checkoutSesh, event.Created); err != nil {
+			return err
 		}
 
 	default:
-		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "didn't receive a valid event"})
+		return errUnhandledStripeEvent
 	}
 
-	return e.JSON(http.StatusOK, map[string]interface{}{"success": "data was received"})
+	return nil
 }
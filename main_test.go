@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
+	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/tests"
 	"github.com/stripe/stripe-go/v76"
@@ -29,7 +32,20 @@ func registerRoutes(e *core.ServeEvent) {
 	e.Router.GET("/goext/{name}", handleHello)
 	e.Router.POST("/create-checkout-session", handleCreateCheckoutSession)
 	e.Router.POST("/create-portal-link", handleCreatePortalLink)
+	e.Router.POST("/preview-plan-change", handlePreviewPlanChange)
+	e.Router.POST("/change-plan", handleChangePlan)
+	e.Router.POST("/cancel-subscription", handleCancelSubscription)
+	e.Router.POST("/reactivate-subscription", handleReactivateSubscription)
+	e.Router.POST("/pause-subscription", handlePauseSubscription)
+	e.Router.POST("/resume-subscription", handleResumeSubscription)
+	e.Router.POST("/retention-offer", handleRetentionOffer)
+	e.Router.POST("/accept-retention-offer", handleAcceptRetentionOffer)
 	e.Router.POST("/stripe", handleStripeWebhook)
+	e.Router.POST("/stripe/events/replay", handleReplayStripeEvents).Bind(apis.RequireSuperuserAuth())
+	e.Router.POST("/stripe/events/{id}/replay", handleReplayStripeEvent).Bind(apis.RequireSuperuserAuth())
+	e.Router.POST("/stripe/sync/catalog", handleSyncStripeCatalog).Bind(apis.RequireSuperuserAuth())
+	e.Router.POST("/stripe/sync/subscriptions", handleReconcileStripeSubscriptions).Bind(apis.RequireSuperuserAuth())
+	e.Router.POST("/stripe/drift", handleCheckSubscriptionDrift).Bind(apis.RequireSuperuserAuth())
 }
 
 func runEndpointScenarios(t *testing.T, cases []endpointScenario) {
@@ -65,17 +81,100 @@ func runEndpointScenarios(t *testing.T, cases []endpointScenario) {
 	}
 }
 
+// lastCheckoutSessionForm and lastBillingPortalSessionForm hold the
+// parameters of the last sessions created through the Stripe mock,
+// lastCustomerForm those of the last customer and lastSubscriptionForm those
+// of the last change to sub_plan. refundedSubscriptionCanceled tells whether
+// sub_refunded was canceled.
+var (
+	lastCheckoutSessionForm      url.Values
+	lastBillingPortalSessionForm url.Values
+	lastCustomerForm             url.Values
+	lastSubscriptionForm         url.Values
+	refundedSubscriptionCanceled bool
+)
+
 func setupStripeMock(t testing.TB) {
 	t.Helper()
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/v1/customers":
+			if r.Method == http.MethodGet {
+				writeStripeResponse(w, `{"object":"list","url":"/v1/customers","has_more":false,"data":[{"id":"cus_test","object":"customer","metadata":{"pocketbaseUUID":"user_test"}},{"id":"cus_other","object":"customer","metadata":{}}]}`)
+				return
+			}
+			if err := r.ParseForm(); err == nil {
+				lastCustomerForm = r.PostForm
+			}
 			writeStripeResponse(w, `{"id":"cus_test","object":"customer"}`)
+		case "/v1/subscriptions":
+			writeStripeResponse(w, `{"object":"list","url":"/v1/subscriptions","has_more":false,"data":[`+
+				`{"id":"sub_missing","object":"subscription","customer":"cus_test","status":"active","current_period_start":1700000000,"current_period_end":1702592000,"items":{"object":"list","data":[{"id":"si_1","object":"subscription_item","quantity":1,"price":{"id":"price_test","object":"price"}}]}},`+
+				`{"id":"sub_drifted","object":"subscription","customer":"cus_test","status":"canceled","current_period_start":1700000000,"current_period_end":1702592000,"items":{"object":"list","data":[{"id":"si_2","object":"subscription_item","quantity":2,"price":{"id":"price_test","object":"price"}}]}}`+
+				`]}`)
+		case "/v1/charges/ch_disputed":
+			writeStripeResponse(w, `{"id":"ch_disputed","object":"charge","customer":"cus_test","payment_intent":"pi_test","currency":"usd","amount":5000}`)
+		case "/v1/subscriptions/sub_sepa":
+			writeStripeResponse(w, `{"id":"sub_sepa","object":"subscription","customer":"cus_test","status":"active","items":{"object":"list","data":[{"id":"si_sepa","object":"subscription_item","quantity":1,"price":{"id":"price_test","object":"price"}}]}}`)
+		case "/v1/subscriptions/sub_dunning":
+			writeStripeResponse(w, `{"id":"sub_dunning","object":"subscription","status":"canceled"}`)
+		case "/v1/subscriptions/sub_refunded":
+			if r.Method == http.MethodDelete {
+				refundedSubscriptionCanceled = true
+			}
+			writeStripeResponse(w, `{"id":"sub_refunded","object":"subscription","status":"canceled"}`)
+		case "/v1/subscriptions/sub_plan":
+			// echo the changes the request makes to the subscription
+			price, quantity, status, cancelAtPeriodEnd, pauseCollection, cancellationDetails := "price_base", "1", "active", "false", "null", "null"
+			if r.Method == http.MethodDelete {
+				// canceling deletes the subscription, ParseForm ignores the body of DELETE requests
+				status = "canceled"
+				r.Method = http.MethodPost
+			}
+			if err := r.ParseForm(); err == nil {
+				lastSubscriptionForm = r.Form
+				if r.Form.Get("items[0][price]") != "" {
+					price = r.Form.Get("items[0][price]")
+				}
+				if r.Form.Get("items[0][quantity]") != "" {
+					quantity = r.Form.Get("items[0][quantity]")
+				}
+				if r.Form.Get("cancel_at_period_end") != "" {
+					cancelAtPeriodEnd = r.Form.Get("cancel_at_period_end")
+				}
+				if r.Form.Get("pause_collection[behavior]") != "" {
+					resumesAt := r.Form.Get("pause_collection[resumes_at]")
+					if resumesAt == "" {
+						resumesAt = "0"
+					}
+					pauseCollection = fmt.Sprintf(`{"behavior":"%s","resumes_at":%s}`, r.Form.Get("pause_collection[behavior]"), resumesAt)
+				}
+				if r.Form.Get("cancellation_details[feedback]") != "" {
+					cancellationDetails = fmt.Sprintf(`{"reason":"cancellation_requested","feedback":"%s","comment":"%s"}`, r.Form.Get("cancellation_details[feedback]"), r.Form.Get("cancellation_details[comment]"))
+				}
+			}
+			writeStripeResponse(w, `{"id":"sub_plan","object":"subscription","customer":"cus_test","status":"`+status+`","cancel_at_period_end":`+cancelAtPeriodEnd+`,"pause_collection":`+pauseCollection+`,"cancellation_details":`+cancellationDetails+`,"items":{"object":"list","data":[{"id":"si_plan","object":"subscription_item","quantity":`+quantity+`,"price":{"id":"`+price+`","object":"price"}}]}}`)
+		case "/v1/coupons/co_retain":
+			writeStripeResponse(w, `{"id":"co_retain","object":"coupon","name":"Stay with us","valid":true,"percent_off":50,"duration":"repeating","duration_in_months":3}`)
+		case "/v1/invoices/upcoming":
+			writeStripeResponse(w, `{"object":"invoice","currency":"usd","amount_due":3000,"next_payment_attempt":1702592000,"lines":{"object":"list","data":[{"id":"il_unused","object":"line_item","amount":-1000,"proration":true},{"id":"il_remaining","object":"line_item","amount":2500,"proration":true},{"id":"il_next","object":"line_item","amount":1500,"proration":false}]}}`)
+		case "/v1/checkout/sessions/cs_payment/line_items":
+			writeStripeResponse(w, `{"object":"list","url":"/v1/checkout/sessions/cs_payment/line_items","has_more":false,"data":[{"id":"li_test","object":"item","description":"Lifetime deal","quantity":1,"currency":"usd","amount_subtotal":5000,"amount_total":5000,"price":{"id":"price_one_time","object":"price","product":"prod_test"}}]}`)
 		case "/v1/checkout/sessions":
+			if err := r.ParseForm(); err == nil {
+				lastCheckoutSessionForm = r.PostForm
+			}
 			writeStripeResponse(w, `{"id":"cs_test","object":"checkout.session"}`)
 		case "/v1/billing_portal/sessions":
+			if err := r.ParseForm(); err == nil {
+				lastBillingPortalSessionForm = r.PostForm
+			}
 			writeStripeResponse(w, `{"id":"bps_test","object":"billing_portal.session","url":"https://example.com/portal"}`)
+		case "/v1/products":
+			writeStripeResponse(w, `{"object":"list","url":"/v1/products","has_more":false,"data":[{"id":"prod_test","object":"product","active":true,"name":"Test product","metadata":{}}]}`)
+		case "/v1/prices":
+			writeStripeResponse(w, `{"object":"list","url":"/v1/prices","has_more":false,"data":[{"id":"price_test","object":"price","active":true,"currency":"usd","product":"prod_test","type":"recurring","unit_amount":1000,"lookup_key":"pro_monthly","recurring":{"interval":"month","interval_count":1}}]}`)
 		default:
 			http.NotFound(w, r)
 		}
@@ -112,7 +211,8 @@ func ensureCustomerCollection(t testing.TB, app *tests.TestApp) *core.Collection
 
 	collection = core.NewBaseCollection("customer")
 	collection.Fields.Add(
-		&core.TextField{Name: "user_id", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "organisation_id"},
 		&core.TextField{Name: "stripe_customer_id", Required: true},
 	)
 
@@ -138,6 +238,141 @@ func ensureProductCollection(t testing.TB, app *tests.TestApp) *core.Collection
 		&core.TextField{Name: "name"},
 		&core.TextField{Name: "description"},
 		&core.JSONField{Name: "metadata"},
+		&core.DateField{Name: "deleted_at"},
+		&core.DateField{Name: "last_event_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func ensurePriceCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("price")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("price")
+	collection.Fields.Add(
+		&core.TextField{Name: "price_id", Required: true},
+		&core.TextField{Name: "product_id"},
+		&core.BoolField{Name: "active"},
+		&core.TextField{Name: "description"},
+		&core.TextField{Name: "lookup_key"},
+		&core.TextField{Name: "currency"},
+		&core.NumberField{Name: "unit_amount"},
+		&core.TextField{Name: "type"},
+		&core.TextField{Name: "interval"},
+		&core.NumberField{Name: "interval_count"},
+		&core.NumberField{Name: "trial_period_days"},
+		&core.JSONField{Name: "metadata"},
+		&core.DateField{Name: "deleted_at"},
+		&core.DateField{Name: "last_event_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func ensureSubscriptionCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("subscription")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	// every subscription sync also mirrors its items
+	ensureSubscriptionItemCollection(t, app)
+
+	collection = core.NewBaseCollection("subscription")
+	collection.Fields.Add(
+		&core.TextField{Name: "subscription_id", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "organisation_id"},
+		&core.TextField{Name: "status"},
+		&core.TextField{Name: "price_id"},
+		&core.JSONField{Name: "metadata"},
+		&core.NumberField{Name: "quantity"},
+		&core.BoolField{Name: "cancel_at_period_end"},
+		&core.DateField{Name: "current_period_start"},
+		&core.DateField{Name: "current_period_end"},
+		&core.DateField{Name: "ended_at"},
+		&core.DateField{Name: "cancel_at"},
+		&core.DateField{Name: "canceled_at"},
+		&core.DateField{Name: "trial_start"},
+		&core.DateField{Name: "trial_end"},
+		&core.BoolField{Name: "payment_pending"},
+		&core.BoolField{Name: "access"},
+		&core.TextField{Name: "pause_behavior"},
+		&core.DateField{Name: "pause_resumes_at"},
+		&core.TextField{Name: "cancellation_reason"},
+		&core.TextField{Name: "cancellation_feedback"},
+		&core.TextField{Name: "cancellation_comment"},
+		&core.DateField{Name: "retention_offer_accepted_at"},
+		&core.DateField{Name: "last_event_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func ensureStripeEventCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("stripe_event")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("stripe_event")
+	collection.Fields.Add(
+		&core.TextField{Name: "event_id", Required: true},
+		&core.TextField{Name: "type"},
+		&core.DateField{Name: "event_created"},
+		&core.TextField{Name: "status"},
+		&core.TextField{Name: "error"},
+		&core.NumberField{Name: "attempts", OnlyInt: true},
+		&core.DateField{Name: "next_attempt_at"},
+		&core.DateField{Name: "processed_at"},
+		&core.JSONField{Name: "payload"},
+	)
+	collection.AddIndex("idx_stripe_event_event_id", true, "event_id", "")
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func ensureStripeDeadLetterCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("stripe_event_dead_letter")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("stripe_event_dead_letter")
+	collection.Fields.Add(
+		&core.TextField{Name: "event_id", Required: true},
+		&core.TextField{Name: "type"},
+		&core.TextField{Name: "error"},
+		&core.NumberField{Name: "attempts", OnlyInt: true},
+		&core.DateField{Name: "failed_at"},
+		&core.JSONField{Name: "payload"},
 	)
 
 	if err := app.Save(collection); err != nil {
@@ -241,6 +476,7 @@ func TestCreateCheckoutSessionEndpoint(t *testing.T) {
 				setupStripeMock(t)
 				stripeSuccessURL = "https://example.com/success"
 				stripeCancelURL = "https://example.com/cancel"
+				ensureCatalogPrice(t, app, "price_test", "one_time")
 				ensureCustomerCollection(t, app)
 				_, token := authTokenForTestUser(t, app)
 				scenario.Headers = map[string]string{
@@ -271,6 +507,8 @@ func TestCreateCheckoutSessionEndpoint(t *testing.T) {
 				setupStripeMock(t)
 				stripeSuccessURL = "https://example.com/success"
 				stripeCancelURL = "https://example.com/cancel"
+				ensureCatalogPrice(t, app, "price_test", "recurring")
+				ensureSubscriptionCollection(t, app)
 
 				collection := ensureCustomerCollection(t, app)
 				user, token := authTokenForTestUser(t, app)
@@ -356,7 +594,7 @@ func TestCreatePortalLinkEndpoint(t *testing.T) {
 }
 
 func TestStripeWebhookEndpoint(t *testing.T) {
-	payloadUnknown := []byte(fmt.Sprintf(`{"id":"evt_test","object":"event","api_version":"%s","type":"invoice.created","data":{"object":{"id":"in_123"}}}`, stripe.APIVersion))
+	payloadUnknown := []byte(fmt.Sprintf(`{"id":"evt_test","object":"event","api_version":"%s","type":"balance.available","data":{"object":{"object":"balance"}}}`, stripe.APIVersion))
 	signedUnknown := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
 		Payload: payloadUnknown,
 		Secret:  "whsec_test",
@@ -368,6 +606,12 @@ func TestStripeWebhookEndpoint(t *testing.T) {
 		Secret:  "whsec_test",
 	})
 
+	payloadStaleProduct := []byte(fmt.Sprintf(`{"id":"evt_stale","object":"event","api_version":"%s","created":1700000000,"type":"product.updated","data":{"object":{"id":"prod_test","object":"product","active":true,"name":"Stale product"}}}`, stripe.APIVersion))
+	signedStaleProduct := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadStaleProduct,
+		Secret:  "whsec_test",
+	})
+
 	runEndpointScenarios(t, []endpointScenario{
 		{
 			name:           "stripe webhook invalid signature",
@@ -386,19 +630,29 @@ func TestStripeWebhookEndpoint(t *testing.T) {
 			},
 		},
 		{
-			name:           "stripe webhook unknown event",
+			name:           "stripe webhook acknowledges unknown event",
 			method:         http.MethodPost,
 			url:            "/stripe",
 			body:           string(payloadUnknown),
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusOK,
 			expectedContent: []string{
-				`"failure":"didn't receive a valid event"`,
+				`"success":"data was received"`,
 			},
 			headers: map[string]string{
 				"Stripe-Signature": signedUnknown.Header,
 			},
 			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
 				WHSEC = "whsec_test"
+				ensureStripeEventCollection(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "ignored" {
+					t.Fatalf("Expected stripe event status to be ignored, got %s", record.GetString("status"))
+				}
 			},
 		},
 		{
@@ -415,6 +669,7 @@ func TestStripeWebhookEndpoint(t *testing.T) {
 			},
 			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
 				WHSEC = "whsec_test"
+				ensureStripeEventCollection(t, app)
 				ensureProductCollection(t, app)
 			},
 			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
@@ -425,6 +680,190 @@ func TestStripeWebhookEndpoint(t *testing.T) {
 				if record.GetString("name") != "Test product" {
 					t.Fatalf("Expected product name to be Test product, got %s", record.GetString("name"))
 				}
+
+				eventRecord, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if eventRecord.GetString("status") != "processed" {
+					t.Fatalf("Expected stripe event status to be processed, got %s", eventRecord.GetString("status"))
+				}
+				if eventRecord.GetString("type") != "product.created" {
+					t.Fatalf("Expected stripe event type to be product.created, got %s", eventRecord.GetString("type"))
+				}
+			},
+		},
+		{
+			name:           "stripe webhook skips processed event",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadProduct),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"event already processed"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedProduct.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				ensureProductCollection(t, app)
+				collection := ensureStripeEventCollection(t, app)
+				eventRecord := core.NewRecord(collection)
+				eventRecord.Set("event_id", "evt_test")
+				eventRecord.Set("type", "product.created")
+				eventRecord.Set("status", "processed")
+				if err := app.Save(eventRecord); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if _, err := app.FindFirstRecordByData("product", "product_id", "prod_test"); err == nil {
+					t.Fatal("Expected processed event not to be synced again")
+				}
+			},
+		},
+		{
+			name:           "stripe webhook leaves dead lettered event to replay",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadProduct),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"event is dead lettered"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedProduct.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				ensureProductCollection(t, app)
+				collection := ensureStripeEventCollection(t, app)
+				eventRecord := core.NewRecord(collection)
+				eventRecord.Set("event_id", "evt_test")
+				eventRecord.Set("type", "product.created")
+				eventRecord.Set("status", "dead_letter")
+				eventRecord.Set("attempts", stripeWebhookMaxAttempts)
+				if err := app.Save(eventRecord); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if _, err := app.FindFirstRecordByData("product", "product_id", "prod_test"); err == nil {
+					t.Fatal("Expected dead lettered event not to be synced")
+				}
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "dead_letter" || record.GetInt("attempts") != stripeWebhookMaxAttempts {
+					t.Fatalf("Expected the dead letter to be left alone, got %s after %d attempts", record.GetString("status"), record.GetInt("attempts"))
+				}
+			},
+		},
+		{
+			name:           "stripe webhook doesn't mark a rolled back event processed",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadProduct),
+			expectedStatus: http.StatusInternalServerError,
+			expectedContent: []string{
+				`"failure":"could not process stripe event"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedProduct.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				ensureProductCollection(t, app)
+				ensureStripeEventCollection(t, app)
+				// marking the ledger record as processed fails, which rolls back
+				// the event's transaction
+				app.OnRecordUpdate("stripe_event").BindFunc(func(e *core.RecordEvent) error {
+					if e.Record.GetString("status") == stripeEventStatusProcessed {
+						return errors.New("ledger unavailable")
+					}
+					return e.Next()
+				})
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "failed" || !record.GetDateTime("processed_at").IsZero() {
+					t.Fatalf("Expected a failed event without processed_at, got %s at %v", record.GetString("status"), record.GetDateTime("processed_at"))
+				}
+				if _, err := app.FindFirstRecordByData("product", "product_id", "prod_test"); err == nil {
+					t.Fatal("Expected the product of the rolled back event not to be saved")
+				}
+			},
+		},
+		{
+			name:           "stripe webhook ignores stale event",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadStaleProduct),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedStaleProduct.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				ensureStripeEventCollection(t, app)
+				collection := ensureProductCollection(t, app)
+				productRecord := core.NewRecord(collection)
+				productRecord.Set("product_id", "prod_test")
+				productRecord.Set("name", "Current product")
+				productRecord.Set("last_event_created", int64ToISODate(1700000100))
+				if err := app.Save(productRecord); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("product", "product_id", "prod_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("name") != "Current product" {
+					t.Fatalf("Expected stale event to be ignored, got product name %s", record.GetString("name"))
+				}
+			},
+		},
+		{
+			name:           "stripe webhook ignores event outside allowlist",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadProduct),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedProduct.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				stripeEventAllowlist = parseCommaList("price.created, price.updated")
+				ensureStripeEventCollection(t, app)
+				ensureProductCollection(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				defer func() { stripeEventAllowlist = nil }()
+
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "ignored" {
+					t.Fatalf("Expected stripe event status to be ignored, got %s", record.GetString("status"))
+				}
+				if _, err := app.FindFirstRecordByData("product", "product_id", "prod_test"); err == nil {
+					t.Fatal("Expected product event outside the allowlist not to be synced")
+				}
 			},
 		},
 	})
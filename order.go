@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	checkoutSession "github.com/stripe/stripe-go/v76/checkout/session"
+)
+
+// orderLineItem is a purchased line item as stored in the line_items field of
+// an order.
+type orderLineItem struct {
+	PriceID        string `json:"price_id"`
+	ProductID      string `json:"product_id"`
+	Description    string `json:"description"`
+	Quantity       int64  `json:"quantity"`
+	Currency       string `json:"currency"`
+	AmountSubtotal int64  `json:"amount_subtotal"`
+	AmountTotal    int64  `json:"amount_total"`
+}
+
+// checkoutSessionLineItems returns the line items of a checkout session. They
+// aren't part of the webhook payload unless expanded, so they are listed from
+// the Stripe API when missing.
+func checkoutSessionLineItems(checkoutSesh *stripe.CheckoutSession) ([]orderLineItem, error) {
+	var lineItems []*stripe.LineItem
+	if checkoutSesh.LineItems != nil && len(checkoutSesh.LineItems.Data) > 0 {
+		lineItems = checkoutSesh.LineItems.Data
+	} else {
+		params := &stripe.CheckoutSessionListLineItemsParams{
+			Session: stripe.String(checkoutSesh.ID),
+		}
+		params.Limit = stripe.Int64(100)
+		params.AddExpand("data.price")
+		items := checkoutSession.ListLineItems(params)
+		for items.Next() {
+			lineItems = append(lineItems, items.LineItem())
+		}
+		if err := items.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]orderLineItem, 0, len(lineItems))
+	for _, lineItem := range lineItems {
+		item := orderLineItem{
+			Description:    lineItem.Description,
+			Quantity:       lineItem.Quantity,
+			Currency:       string(lineItem.Currency),
+			AmountSubtotal: lineItem.AmountSubtotal,
+			AmountTotal:    lineItem.AmountTotal,
+		}
+		if lineItem.Price != nil {
+			item.PriceID = lineItem.Price.ID
+			if lineItem.Price.Product != nil {
+				item.ProductID = lineItem.Price.Product.ID
+			}
+		}
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// upsertOrder mirrors a payment mode checkout session into the order
+// collection, linking it to the user through the customer mapping table.
+// paymentStatus is stored as the order status, see checkoutPaymentStatus, and
+// syncedAt has the same meaning as for upsertSubscription. lineItems are the
+// session's line items, see checkoutSessionLineItems. It returns a nil record
+// when the stored order is newer and the update was skipped.
+func upsertOrder(app core.App, checkoutSesh *stripe.CheckoutSession, lineItems []orderLineItem, paymentStatus string, syncedAt int64) (*core.Record, error) {
+	if checkoutSesh.Customer == nil {
+		app.Logger().Error("checkout session missing customer", "sessionId", checkoutSesh.ID)
+		return nil, newStripeEventError(http.StatusBadRequest, "missing checkout customer", nil)
+	}
+
+	existingCustomer, err := app.FindFirstRecordByData("customer", "stripe_customer_id", checkoutSesh.Customer.ID)
+	if err != nil {
+		app.Logger().Error("could not find customer record for checkout session", "sessionId", checkoutSesh.ID, "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "no customer", err)
+	}
+
+	collection, err := app.FindCollectionByNameOrId("order")
+	if err != nil {
+		app.Logger().Error("could not find collection order", "error", err)
+		return nil, newStripeEventError(http.StatusInternalServerError, "could not find collection order", err)
+	}
+
+	existingRecord, err := app.FindFirstRecordByData("order", "checkout_session_id", checkoutSesh.ID)
+	var recordToSave *core.Record
+
+	if err == nil && existingRecord != nil {
+		recordToSave = existingRecord
+	} else {
+		recordToSave = core.NewRecord(collection)
+	}
+
+	if isStaleStripeEvent(recordToSave, syncedAt) {
+		app.Logger().Info("skipping stale order update", "sessionId", checkoutSesh.ID)
+		return nil, nil
+	}
+
+	recordToSave.Set("checkout_session_id", checkoutSesh.ID)
+	recordToSave.Set("user_id", existingCustomer.GetString("user_id"))
+	recordToSave.Set("organisation_id", existingCustomer.GetString("organisation_id"))
+	recordToSave.Set("stripe_customer_id", checkoutSesh.Customer.ID)
+	if checkoutSesh.PaymentIntent != nil {
+		recordToSave.Set("payment_intent", checkoutSesh.PaymentIntent.ID)
+	}
+	recordToSave.Set("status", paymentStatus)
+	recordToSave.Set("currency", checkoutSesh.Currency)
+	recordToSave.Set("amount_subtotal", checkoutSesh.AmountSubtotal)
+	recordToSave.Set("amount_total", checkoutSesh.AmountTotal)
+	recordToSave.Set("line_items", lineItems)
+	recordToSave.Set("metadata", checkoutSesh.Metadata)
+	recordToSave.Set("last_event_created", int64ToISODate(syncedAt))
+
+	if err = app.Save(recordToSave); err != nil {
+		app.Logger().Error("could not save order record", "sessionId", checkoutSesh.ID, "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "could not save order record", err)
+	}
+
+	return recordToSave, nil
+}
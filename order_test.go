@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func ensureOrderCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("order")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("order")
+	collection.Fields.Add(
+		&core.TextField{Name: "checkout_session_id", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "organisation_id"},
+		&core.TextField{Name: "stripe_customer_id"},
+		&core.TextField{Name: "payment_intent"},
+		&core.TextField{Name: "status"},
+		&core.TextField{Name: "currency"},
+		&core.NumberField{Name: "amount_subtotal", OnlyInt: true},
+		&core.NumberField{Name: "amount_total", OnlyInt: true},
+		&core.JSONField{Name: "line_items"},
+		&core.JSONField{Name: "metadata"},
+		&core.DateField{Name: "last_event_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func TestCheckoutPaymentOrders(t *testing.T) {
+	payloadPayment := []byte(fmt.Sprintf(`{"id":"evt_checkout_payment","object":"event","api_version":"%s","created":1700000000,"type":"checkout.session.completed","data":{"object":{"id":"cs_payment","object":"checkout.session","mode":"payment","customer":"cus_test","payment_intent":"pi_test","payment_status":"paid","status":"complete","currency":"usd","amount_subtotal":5000,"amount_total":5000}}}`, stripe.APIVersion))
+	signedPayment := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadPayment,
+		Secret:  "whsec_test",
+	})
+
+	payloadMissing := []byte(fmt.Sprintf(`{"id":"evt_checkout_missing","object":"event","api_version":"%s","created":1700000000,"type":"checkout.session.completed","data":{"object":{"id":"cs_missing","object":"checkout.session","mode":"payment","customer":"cus_test","payment_status":"paid","status":"complete"}}}`, stripe.APIVersion))
+	signedMissing := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadMissing,
+		Secret:  "whsec_test",
+	})
+
+	setup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+		WHSEC = "whsec_test"
+		setupStripeMock(t)
+		ensureStripeEventCollection(t, app)
+		ensureOrderCollection(t, app)
+		ensureCheckoutSessionCollection(t, app)
+		collection := ensureCustomerCollection(t, app)
+		record := core.NewRecord(collection)
+		record.Set("user_id", "user_test")
+		record.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "completed payment checkout creates an order",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadPayment),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedPayment.Header,
+			},
+			setup: setup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("order", "checkout_session_id", "cs_payment")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("user_id") != "user_test" {
+					t.Fatalf("Expected order user_id to be user_test, got %s", record.GetString("user_id"))
+				}
+				if record.GetString("payment_intent") != "pi_test" {
+					t.Fatalf("Expected order payment_intent to be pi_test, got %s", record.GetString("payment_intent"))
+				}
+				if record.GetString("status") != "paid" {
+					t.Fatalf("Expected order status to be paid, got %s", record.GetString("status"))
+				}
+				if record.GetInt("amount_total") != 5000 {
+					t.Fatalf("Expected order amount_total to be 5000, got %d", record.GetInt("amount_total"))
+				}
+
+				var lineItems []orderLineItem
+				if err := json.Unmarshal([]byte(record.GetString("line_items")), &lineItems); err != nil {
+					t.Fatal(err)
+				}
+				if len(lineItems) != 1 || lineItems[0].PriceID != "price_one_time" || lineItems[0].ProductID != "prod_test" {
+					t.Fatalf("Expected one line item for price_one_time, got %+v", lineItems)
+				}
+			},
+		},
+		{
+			name:           "line items that can't be listed fail the event before it is synced",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadMissing),
+			expectedStatus: http.StatusInternalServerError,
+			expectedContent: []string{
+				`"failure":"could not list checkout line items"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedMissing.Header,
+			},
+			setup: setup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if _, err := app.FindFirstRecordByData("checkout_session", "checkout_session_id", "cs_missing"); err == nil {
+					t.Fatal("Expected the checkout session not to be synced")
+				}
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_checkout_missing")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != stripeEventStatusFailed {
+					t.Fatalf("Expected the event to be failed, got %s", record.GetString("status"))
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// registerOrganisationSeatHooks keeps the quantity of organisation
+// subscriptions equal to the number of members of the organisation. The
+// seats are synced once the membership change is committed. A seat change
+// that can't be synced is logged and doesn't fail the membership change, the
+// next member change or a plan change corrects it.
+func registerOrganisationSeatHooks(app core.App) {
+	app.OnRecordAfterCreateSuccess("organisation_member").BindFunc(func(e *core.RecordEvent) error {
+		syncOrganisationSeatsLogged(e.App, e.Record.GetString("organisation_id"))
+		return e.Next()
+	})
+
+	// a member moved to another organisation frees a seat in the old one,
+	// which is no longer known once the update is committed, so every
+	// organisation is reconciled with its members
+	app.OnRecordAfterUpdateSuccess("organisation_member").BindFunc(func(e *core.RecordEvent) error {
+		syncAllOrganisationSeatsLogged(e.App)
+		return e.Next()
+	})
+
+	app.OnRecordAfterDeleteSuccess("organisation_member").BindFunc(func(e *core.RecordEvent) error {
+		syncOrganisationSeatsLogged(e.App, e.Record.GetString("organisation_id"))
+		return e.Next()
+	})
+}
+
+func syncOrganisationSeatsLogged(app core.App, organisationID string) {
+	updated, err := syncOrganisationSeats(app, organisationID)
+	if err != nil {
+		app.Logger().Error("could not sync organisation seats", "organisationId", organisationID, "error", err)
+		return
+	}
+	if updated > 0 {
+		app.Logger().Info("synced organisation seats", "organisationId", organisationID, "updated", updated)
+	}
+}
+
+// syncAllOrganisationSeatsLogged syncs the seats of every organisation with a
+// current subscription. Organisations whose seats already match their members
+// aren't sent to Stripe.
+func syncAllOrganisationSeatsLogged(app core.App) {
+	records, err := app.FindRecordsByFilter(
+		"subscription",
+		"organisation_id != '' && (status = {:active} || status = {:trialing} || status = {:pastDue})",
+		"",
+		0,
+		0,
+		dbx.Params{
+			"active":   stripe.SubscriptionStatusActive,
+			"trialing": stripe.SubscriptionStatusTrialing,
+			"pastDue":  stripe.SubscriptionStatusPastDue,
+		},
+	)
+	if err != nil {
+		app.Logger().Error("could not find organisation subscriptions", "error", err)
+		return
+	}
+
+	synced := map[string]bool{}
+	for _, record := range records {
+		organisationID := record.GetString("organisation_id")
+		if synced[organisationID] {
+			continue
+		}
+		synced[organisationID] = true
+		syncOrganisationSeatsLogged(app, organisationID)
+	}
+}
+
+// countOrganisationSeats returns the number of seats an organisation pays
+// for: one per member, at least one.
+func countOrganisationSeats(app core.App, organisationID string) (int64, error) {
+	members, err := app.CountRecords("organisation_member", dbx.HashExp{"organisation_id": organisationID})
+	if err != nil {
+		return 0, err
+	}
+	return max(members, 1), nil
+}
+
+// applyOrganisationSeats sets the quantity of the first recurring item of an
+// organisation checkout, its seat item, to the organisation's seats. The seats
+// follow the members from then on, so the quantity can't be adjusted.
+func applyOrganisationSeats(app core.App, organisationID string, items []checkoutItem) error {
+	seats, err := countOrganisationSeats(app, organisationID)
+	if err != nil {
+		return err
+	}
+	for i := range items {
+		if items[i].PriceType == "recurring" {
+			items[i].Quantity = seats
+			items[i].AdjustableQuantity = false
+			return nil
+		}
+	}
+	return nil
+}
+
+// syncOrganisationSeats sets the quantity of the current subscriptions of an
+// organisation to its number of members, at least one, and returns how many
+// subscriptions were updated. Stripe prorates the change with
+// STRIPE_PRORATION_BEHAVIOR.
+func syncOrganisationSeats(app core.App, organisationID string) (int, error) {
+	if organisationID == "" {
+		return 0, nil
+	}
+
+	seats, err := countOrganisationSeats(app, organisationID)
+	if err != nil {
+		return 0, err
+	}
+
+	records, err := app.FindRecordsByFilter(
+		"subscription",
+		"organisation_id = {:organisationId} && (status = {:active} || status = {:trialing} || status = {:pastDue})",
+		"",
+		0,
+		0,
+		dbx.Params{
+			"organisationId": organisationID,
+			"active":         stripe.SubscriptionStatusActive,
+			"trialing":       stripe.SubscriptionStatusTrialing,
+			"pastDue":        stripe.SubscriptionStatusPastDue,
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, record := range records {
+		if int64(record.GetInt("quantity")) == seats {
+			continue
+		}
+		subscriptionID := record.GetString("subscription_id")
+
+		// the seats are counted on the item stored as the subscription's price
+		item, err := app.FindFirstRecordByFilter(
+			"subscription_item",
+			"subscription_id = {:subscriptionId} && price_id = {:priceId}",
+			dbx.Params{"subscriptionId": subscriptionID, "priceId": record.GetString("price_id")},
+		)
+		if err != nil {
+			return updated, fmt.Errorf("could not find seat item of subscription %s: %w", subscriptionID, err)
+		}
+
+		subscription, err := stripeSubscription.Update(subscriptionID, &stripe.SubscriptionParams{
+			Items: []*stripe.SubscriptionItemsParams{{
+				ID:       stripe.String(item.GetString("item_id")),
+				Quantity: stripe.Int64(seats),
+			}},
+			ProrationBehavior: stripe.String(stripeProrationBehavior),
+		})
+		if err != nil {
+			return updated, fmt.Errorf("could not update seats of subscription %s: %w", subscriptionID, err)
+		}
+
+		if _, err = upsertSubscription(app, subscription, 0); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+
+	return updated, nil
+}
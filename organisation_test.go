@@ -0,0 +1,159 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func ensureOrganisationMemberCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("organisation_member")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("organisation_member")
+	collection.Fields.Add(
+		&core.TextField{Name: "organisation_id", Required: true},
+		&core.TextField{Name: "user_id", Required: true},
+		&core.TextField{Name: "role"},
+	)
+	collection.AddIndex("idx_organisation_member_user", true, "organisation_id, user_id", "")
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func ensureOrganisationRecord(t testing.TB, app *tests.TestApp) *core.Record {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("organisation")
+	if err != nil || collection == nil {
+		collection = core.NewBaseCollection("organisation")
+		collection.Fields.Add(
+			&core.TextField{Name: "name"},
+			&core.TextField{Name: "billing_flag"},
+		)
+		if err := app.Save(collection); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("id", "orgtest00000000")
+	record.Set("name", "Acme")
+	if err := app.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	return record
+}
+
+func TestOrganisationSeats(t *testing.T) {
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Cleanup()
+
+	setupStripeMock(t)
+	registerOrganisationSeatHooks(app)
+	members := ensureOrganisationMemberCollection(t, app)
+
+	customer := core.NewRecord(ensureCustomerCollection(t, app))
+	customer.Set("organisation_id", "org_test")
+	customer.Set("stripe_customer_id", "cus_test")
+	if err := app.Save(customer); err != nil {
+		t.Fatal(err)
+	}
+
+	subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+	subscription.Set("subscription_id", "sub_plan")
+	subscription.Set("organisation_id", "org_test")
+	subscription.Set("status", "active")
+	subscription.Set("price_id", "price_base")
+	subscription.Set("quantity", 1)
+	if err := app.Save(subscription); err != nil {
+		t.Fatal(err)
+	}
+
+	item := core.NewRecord(ensureSubscriptionItemCollection(t, app))
+	item.Set("item_id", "si_plan")
+	item.Set("subscription_id", "sub_plan")
+	item.Set("price_id", "price_base")
+	item.Set("quantity", 1)
+	if err := app.Save(item); err != nil {
+		t.Fatal(err)
+	}
+
+	quantity := func() int {
+		t.Helper()
+		record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_plan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record.GetInt("quantity")
+	}
+
+	var memberRecords []*core.Record
+	for _, userID := range []string{"user_one", "user_two", "user_three"} {
+		member := core.NewRecord(members)
+		member.Set("organisation_id", "org_test")
+		member.Set("user_id", userID)
+		if err := app.Save(member); err != nil {
+			t.Fatal(err)
+		}
+		memberRecords = append(memberRecords, member)
+	}
+
+	if quantity() != 3 {
+		t.Fatalf("Expected 3 seats after adding members, got %d", quantity())
+	}
+	if lastSubscriptionForm.Get("items[0][id]") != "si_plan" || lastSubscriptionForm.Get("proration_behavior") != "create_prorations" {
+		t.Fatalf("Expected a prorated update of the seat item, got %v", lastSubscriptionForm)
+	}
+	record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_plan")
+	if err != nil || record.GetString("organisation_id") != "org_test" || record.GetString("user_id") != "" {
+		t.Fatalf("Expected the subscription to stay with the organisation, got %v", record)
+	}
+
+	if err := app.Delete(memberRecords[0]); err != nil {
+		t.Fatal(err)
+	}
+	if quantity() != 2 {
+		t.Fatalf("Expected 2 seats after removing a member, got %d", quantity())
+	}
+
+	// moving a member to another organisation frees its seat
+	memberRecords[1].Set("organisation_id", "org_other")
+	if err := app.Save(memberRecords[1]); err != nil {
+		t.Fatal(err)
+	}
+	if quantity() != 1 {
+		t.Fatalf("Expected 1 seat after moving a member, got %d", quantity())
+	}
+
+	// other member changes leave the seats alone
+	lastSubscriptionForm = nil
+	memberRecords[2].Set("role", "billing_admin")
+	if err := app.Save(memberRecords[2]); err != nil {
+		t.Fatal(err)
+	}
+	if quantity() != 1 || lastSubscriptionForm != nil {
+		t.Fatalf("Expected a role change to keep 1 seat without an update, got %d", quantity())
+	}
+
+	// the last member keeps a single seat
+	if err := app.Delete(memberRecords[2]); err != nil {
+		t.Fatal(err)
+	}
+	if quantity() != 1 || lastSubscriptionForm != nil {
+		t.Fatalf("Expected the subscription to keep 1 seat without an update, got %d", quantity())
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/invoice"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// proration behaviors
+const (
+	prorationBehaviorCreateProrations = "create_prorations"
+	prorationBehaviorAlwaysInvoice    = "always_invoice"
+	prorationBehaviorNone             = "none"
+)
+
+// findManagedSubscription returns the subscription record a user wants to
+// manage: the one given as "subscription_id", or the only current
+// subscription of the billing owner when no ID is given (see
+// resolveBillingOwner). Users manage their own subscriptions and those of the
+// organisations they are a billing admin of, other subscriptions are
+// reported as not found.
+func findManagedSubscription(app core.App, user *core.Record, data map[string]interface{}) (*core.Record, error) {
+	if subscriptionID, _ := data["subscription_id"].(string); subscriptionID != "" {
+		record, err := app.FindFirstRecordByData("subscription", "subscription_id", subscriptionID)
+		if err != nil {
+			return nil, &requestError{http.StatusNotFound, "subscription not found"}
+		}
+		if record.GetString("user_id") == user.Id {
+			return record, nil
+		}
+		if organisationID := record.GetString("organisation_id"); organisationID != "" && isBillingAdmin(app, user, organisationID) {
+			return record, nil
+		}
+		return nil, &requestError{http.StatusNotFound, "subscription not found"}
+	}
+
+	owner, err := resolveBillingOwner(app, user, data)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := app.FindRecordsByFilter(
+		"subscription",
+		owner.field()+" = {:ownerId} && (status = {:active} || status = {:trialing} || status = {:pastDue})",
+		"",
+		0,
+		0,
+		dbx.Params{
+			"ownerId":  owner.id(),
+			"active":   stripe.SubscriptionStatusActive,
+			"trialing": stripe.SubscriptionStatusTrialing,
+			"pastDue":  stripe.SubscriptionStatusPastDue,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	switch len(records) {
+	case 0:
+		return nil, &requestError{http.StatusNotFound, "subscription not found"}
+	case 1:
+		return records[0], nil
+	}
+	return nil, &requestError{http.StatusBadRequest, "subscription_id is required"}
+}
+
+// planChange is a requested change of a subscription item to another price
+// or quantity.
+type planChange struct {
+	subscription      *stripe.Subscription
+	item              *stripe.SubscriptionItemsParams
+	prorationBehavior string
+	prorationDate     int64
+}
+
+// preparePlanChange reads a plan change request of the user: the price as in
+// create-checkout-session, an optional quantity (by default the current one),
+// subscription_id or organisation_id and item_id (by default the
+// subscription's primary item) and proration_date (by default now). Pass the
+// proration_date of a preview when applying it, so the amounts match. The
+// quantity of an organisation subscription's seat item is its seats.
+func preparePlanChange(app core.App, user *core.Record, data map[string]interface{}) (*planChange, error) {
+	record, err := findManagedSubscription(app, user, data)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := parseCheckoutItem(data)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err.Error()}
+	}
+	items := []checkoutItem{item}
+	if err = resolveCheckoutItems(app, items); err != nil {
+		return nil, &requestError{http.StatusBadRequest, err.Error()}
+	}
+	if items[0].PriceType != "recurring" {
+		return nil, &requestError{http.StatusBadRequest, "plan must be a recurring price"}
+	}
+
+	subscription, err := stripeSubscription.Get(record.GetString("subscription_id"), nil)
+	if err != nil {
+		app.Logger().Error("could not get subscription", "subscriptionId", record.GetString("subscription_id"), "error", err)
+		return nil, &requestError{http.StatusBadRequest, "could not get subscription"}
+	}
+	if subscription.Items == nil || len(subscription.Items.Data) == 0 {
+		return nil, &requestError{http.StatusBadRequest, "subscription has no items"}
+	}
+
+	// change the requested item, or the one stored as the subscription's price
+	itemID, _ := data["item_id"].(string)
+	var currentItem *stripe.SubscriptionItem
+	for _, subscriptionItem := range subscription.Items.Data {
+		if (itemID != "" && subscriptionItem.ID == itemID) ||
+			(itemID == "" && subscriptionItem.Price != nil && subscriptionItem.Price.ID == record.GetString("price_id")) {
+			currentItem = subscriptionItem
+			break
+		}
+	}
+	if currentItem == nil {
+		if itemID != "" {
+			return nil, &requestError{http.StatusNotFound, "subscription item not found"}
+		}
+		currentItem = subscription.Items.Data[0]
+	}
+
+	quantity := currentItem.Quantity
+	if _, ok := data["quantity"]; ok {
+		quantity = items[0].Quantity
+	}
+	if organisationID := record.GetString("organisation_id"); organisationID != "" && itemID == "" {
+		if quantity, err = countOrganisationSeats(app, organisationID); err != nil {
+			return nil, err
+		}
+	}
+	if currentItem.Price != nil && currentItem.Price.ID == items[0].PriceID && currentItem.Quantity == quantity {
+		return nil, &requestError{http.StatusBadRequest, "subscription already has this plan"}
+	}
+
+	prorationDate := time.Now().Unix()
+	if rawDate, ok := data["proration_date"]; ok {
+		date, ok := rawDate.(float64)
+		if !ok || date <= 0 {
+			return nil, &requestError{http.StatusBadRequest, "invalid proration_date"}
+		}
+		prorationDate = int64(date)
+	}
+
+	return &planChange{
+		subscription: subscription,
+		item: &stripe.SubscriptionItemsParams{
+			ID:       stripe.String(currentItem.ID),
+			Price:    stripe.String(items[0].PriceID),
+			Quantity: stripe.Int64(quantity),
+		},
+		prorationBehavior: stripeProrationBehavior,
+		prorationDate:     prorationDate,
+	}, nil
+}
+
+// handlePreviewPlanChange returns what a plan change would cost: the
+// prorations, the amount charged right away and the upcoming invoice.
+func handlePreviewPlanChange(e *core.RequestEvent) error {
+	data, err := readRequestBody(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+
+	token := e.Request.Header.Get("Authorization")
+	record, err := e.App.FindAuthRecordByToken(token, core.TokenTypeAuth)
+	if err != nil {
+		e.App.Logger().Error("could not find auth record by token", "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not find auth record by token"})
+	}
+
+	change, err := preparePlanChange(e.App, record, data)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+
+	params := &stripe.InvoiceUpcomingParams{
+		Subscription:                  stripe.String(change.subscription.ID),
+		SubscriptionItems:             []*stripe.SubscriptionItemsParams{change.item},
+		SubscriptionProrationBehavior: stripe.String(change.prorationBehavior),
+		SubscriptionProrationDate:     stripe.Int64(change.prorationDate),
+	}
+	if change.subscription.Customer != nil {
+		params.Customer = stripe.String(change.subscription.Customer.ID)
+	}
+	upcoming, err := invoice.Upcoming(params)
+	if err != nil {
+		e.App.Logger().Error("could not preview upcoming invoice", "subscriptionId", change.subscription.ID, "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not preview plan change"})
+	}
+
+	var prorationAmount int64
+	if upcoming.Lines != nil {
+		for _, line := range upcoming.Lines.Data {
+			if line.Proration {
+				prorationAmount += line.Amount
+			}
+		}
+	}
+
+	// only always_invoice bills the prorations right away, credits are kept
+	// for the next invoice
+	var dueNow int64
+	if change.prorationBehavior == prorationBehaviorAlwaysInvoice && prorationAmount > 0 {
+		dueNow = prorationAmount
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"subscription_id":      change.subscription.ID,
+		"price_id":             stripe.StringValue(change.item.Price),
+		"quantity":             stripe.Int64Value(change.item.Quantity),
+		"proration_behavior":   change.prorationBehavior,
+		"proration_date":       change.prorationDate,
+		"currency":             upcoming.Currency,
+		"proration_amount":     prorationAmount,
+		"due_now":              dueNow,
+		"amount_due":           upcoming.AmountDue,
+		"next_payment_attempt": upcoming.NextPaymentAttempt,
+	})
+}
+
+// handleChangePlan moves the user's subscription to another price or
+// quantity and returns the updated subscription record.
+func handleChangePlan(e *core.RequestEvent) error {
+	data, err := readRequestBody(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+
+	token := e.Request.Header.Get("Authorization")
+	record, err := e.App.FindAuthRecordByToken(token, core.TokenTypeAuth)
+	if err != nil {
+		e.App.Logger().Error("could not find auth record by token", "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not find auth record by token"})
+	}
+
+	change, err := preparePlanChange(e.App, record, data)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items:             []*stripe.SubscriptionItemsParams{change.item},
+		ProrationBehavior: stripe.String(change.prorationBehavior),
+		ProrationDate:     stripe.Int64(change.prorationDate),
+	}
+	subscription, err := stripeSubscription.Update(change.subscription.ID, params)
+	if err != nil {
+		e.App.Logger().Error("could not update subscription", "subscriptionId", change.subscription.ID, "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not change plan"})
+	}
+
+	return respondManagedSubscription(e, subscription)
+}
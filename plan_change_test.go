@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestPlanChange(t *testing.T) {
+	setup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario, ownerID string) {
+		setupStripeMock(t)
+		ensureCatalogPrice(t, app, "price_base", "recurring")
+		ensureCatalogPrice(t, app, "price_pro", "recurring")
+		ensureCatalogPrice(t, app, "price_setup", "one_time")
+
+		user, token := authTokenForTestUser(t, app)
+		if ownerID == "" {
+			ownerID = user.Id
+		}
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", ownerID)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_plan")
+		subscription.Set("user_id", ownerID)
+		subscription.Set("price_id", "price_base")
+		subscription.Set("quantity", 1)
+		subscription.Set("status", "active")
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+
+	// orgSetup stores sub_plan as a subscription of an organisation with the
+	// signed in user, who has role, and one other member
+	orgSetup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario, role string) {
+		setupStripeMock(t)
+		lastSubscriptionForm = nil
+		ensureCatalogPrice(t, app, "price_base", "recurring")
+		ensureCatalogPrice(t, app, "price_pro", "recurring")
+		organisation := ensureOrganisationRecord(t, app)
+
+		user, token := authTokenForTestUser(t, app)
+		members := ensureOrganisationMemberCollection(t, app)
+		for userID, memberRole := range map[string]string{user.Id: role, "memberone": organisationRoleMember} {
+			member := core.NewRecord(members)
+			member.Set("organisation_id", organisation.Id)
+			member.Set("user_id", userID)
+			member.Set("role", memberRole)
+			if err := app.Save(member); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("organisation_id", organisation.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_plan")
+		subscription.Set("organisation_id", organisation.Id)
+		subscription.Set("price_id", "price_base")
+		subscription.Set("quantity", 2)
+		subscription.Set("status", "active")
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "preview requires auth",
+			method:         http.MethodPost,
+			url:            "/preview-plan-change",
+			body:           `{"price":{"id":"price_pro"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"could not find auth record by token"`,
+			},
+		},
+		{
+			name:           "preview shows the prorations",
+			method:         http.MethodPost,
+			url:            "/preview-plan-change",
+			body:           `{"price":{"id":"price_pro"}}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"subscription_id":"sub_plan"`,
+				`"price_id":"price_pro"`,
+				`"proration_behavior":"create_prorations"`,
+				`"proration_amount":1500`,
+				`"due_now":0`,
+				`"amount_due":3000`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "")
+			},
+		},
+		{
+			name:           "preview with always_invoice is charged right away",
+			method:         http.MethodPost,
+			url:            "/preview-plan-change",
+			body:           `{"lookup_key":"pro","proration_date":1700000000}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"proration_date":1700000000`,
+				`"due_now":1500`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "")
+				stripeProrationBehavior = prorationBehaviorAlwaysInvoice
+				price, err := app.FindFirstRecordByData("price", "price_id", "price_pro")
+				if err != nil {
+					t.Fatal(err)
+				}
+				price.Set("lookup_key", "pro")
+				if err := app.Save(price); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				stripeProrationBehavior = prorationBehaviorCreateProrations
+			},
+		},
+		{
+			name:           "change moves the subscription to the new price",
+			method:         http.MethodPost,
+			url:            "/change-plan",
+			body:           `{"price":{"id":"price_pro"}}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"subscription_id":"sub_plan"`,
+				`"price_id":"price_pro"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "")
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_plan")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("price_id") != "price_pro" {
+					t.Fatalf("Expected subscription price_id to be price_pro, got %s", record.GetString("price_id"))
+				}
+			},
+		},
+		{
+			name:           "subscription of another user is not found",
+			method:         http.MethodPost,
+			url:            "/change-plan",
+			body:           `{"subscription_id":"sub_plan","price":{"id":"price_pro"}}`,
+			expectedStatus: http.StatusNotFound,
+			expectedContent: []string{
+				`"failure":"subscription not found"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "someoneelse0000")
+			},
+		},
+		{
+			name:           "one_time price is not a plan",
+			method:         http.MethodPost,
+			url:            "/preview-plan-change",
+			body:           `{"price":{"id":"price_setup"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"plan must be a recurring price"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "")
+			},
+		},
+		{
+			name:           "current plan can't be changed to itself",
+			method:         http.MethodPost,
+			url:            "/change-plan",
+			body:           `{"price":{"id":"price_base"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"subscription already has this plan"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "")
+			},
+		},
+		{
+			name:           "billing admin changes the organisation's plan",
+			method:         http.MethodPost,
+			url:            "/change-plan",
+			body:           `{"organisation_id":"orgtest00000000","price":{"id":"price_pro"},"quantity":5}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"subscription_id":"sub_plan"`,
+				`"price_id":"price_pro"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup(t, app, scenario, organisationRoleBillingAdmin)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				// the seats follow the members, not the requested quantity
+				if lastSubscriptionForm.Get("items[0][quantity]") != "2" {
+					t.Fatalf("Expected the plan change to keep 2 seats, got %v", lastSubscriptionForm)
+				}
+			},
+		},
+		{
+			name:           "billing admin previews the organisation's plan change by subscription_id",
+			method:         http.MethodPost,
+			url:            "/preview-plan-change",
+			body:           `{"subscription_id":"sub_plan","price":{"id":"price_pro"}}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"subscription_id":"sub_plan"`,
+				`"quantity":2`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup(t, app, scenario, organisationRoleBillingAdmin)
+			},
+		},
+		{
+			name:           "plain members can't change the organisation's plan",
+			method:         http.MethodPost,
+			url:            "/change-plan",
+			body:           `{"organisation_id":"orgtest00000000","price":{"id":"price_pro"}}`,
+			expectedStatus: http.StatusForbidden,
+			expectedContent: []string{
+				`"failure":"not a billing admin of the organisation"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup(t, app, scenario, organisationRoleMember)
+			},
+		},
+		{
+			name:           "plain members don't find the organisation's subscription",
+			method:         http.MethodPost,
+			url:            "/change-plan",
+			body:           `{"subscription_id":"sub_plan","price":{"id":"price_pro"}}`,
+			expectedStatus: http.StatusNotFound,
+			expectedContent: []string{
+				`"failure":"subscription not found"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup(t, app, scenario, organisationRoleMember)
+			},
+		},
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// stripeEventQueue holds the ids of stripe_event records waiting to be synced
+// by the background workers. It is nil when the webhook syncs events inline.
+var stripeEventQueue chan string
+
+// stripeEventsInFlight tracks the stripe_event records currently being synced
+// so an event picked up by both the webhook and the retry job runs once.
+var stripeEventsInFlight sync.Map
+
+// startStripeEventQueue starts the worker pool that syncs stored events and a
+// cron job that re-queues events which are due for a retry.
+func startStripeEventQueue(app core.App, workers int) {
+	stripeEventQueue = make(chan string, 100)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for recordId := range stripeEventQueue {
+				processQueuedStripeEvent(app, recordId)
+			}
+		}()
+	}
+
+	app.Cron().MustAdd("stripeEventRetries", "* * * * *", func() {
+		enqueueDueStripeEvents(app)
+	})
+
+	// pick up anything left over from before a restart
+	go enqueueDueStripeEvents(app)
+}
+
+// enqueueStripeEvent hands a stripe_event record over to the workers without
+// blocking. Events that don't fit in the queue are picked up by the retry job.
+func enqueueStripeEvent(recordId string) bool {
+	select {
+	case stripeEventQueue <- recordId:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueDueStripeEvents queues every pending or failed event whose next
+// attempt is due.
+func enqueueDueStripeEvents(app core.App) {
+	records, err := app.FindRecordsByFilter(
+		"stripe_event",
+		"(status = {:pending} || status = {:failed}) && next_attempt_at <= {:now}",
+		"next_attempt_at",
+		100,
+		0,
+		dbx.Params{
+			"pending": stripeEventStatusPending,
+			"failed":  stripeEventStatusFailed,
+			"now":     types.NowDateTime().String(),
+		},
+	)
+	if err != nil {
+		app.Logger().Error("could not find due stripe events", "error", err)
+		return
+	}
+
+	for _, record := range records {
+		if !enqueueStripeEvent(record.Id) {
+			break
+		}
+	}
+}
+
+// processQueuedStripeEvent loads a stored event and syncs it, unless it has
+// already been processed, ignored or moved to the dead-letter collection.
+func processQueuedStripeEvent(app core.App, recordId string) {
+	if _, loaded := stripeEventsInFlight.LoadOrStore(recordId, struct{}{}); loaded {
+		return
+	}
+	defer stripeEventsInFlight.Delete(recordId)
+
+	record, err := app.FindRecordById("stripe_event", recordId)
+	if err != nil {
+		app.Logger().Error("could not find stripe event record", "recordId", recordId, "error", err)
+		return
+	}
+
+	status := record.GetString("status")
+	if status == stripeEventStatusProcessed || status == stripeEventStatusDeadLetter || status == stripeEventStatusIgnored {
+		return
+	}
+
+	event, err := stripeEventFromRecord(record)
+	if err != nil {
+		app.Logger().Error("could not decode stored stripe event", "eventId", record.GetString("event_id"), "error", err)
+		record.Set("attempts", record.GetInt("attempts")+1)
+		recordStripeEventFailure(app, record, err)
+		return
+	}
+
+	// failures are already logged and recorded on the ledger record
+	_ = processStripeEvent(app, record, event, false)
+}
+
+// stripeEventFromRecord decodes the raw Stripe payload stored on a
+// stripe_event record.
+func stripeEventFromRecord(record *core.Record) (stripe.Event, error) {
+	var event stripe.Event
+	err := json.Unmarshal([]byte(record.GetString("payload")), &event)
+	return event, err
+}
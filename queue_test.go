@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func TestStripeEventQueue(t *testing.T) {
+	payloadProduct := []byte(fmt.Sprintf(`{"id":"evt_queued","object":"event","api_version":"%s","type":"product.created","data":{"object":{"id":"prod_queued","object":"product","active":true,"name":"Queued product"}}}`, stripe.APIVersion))
+	signedProduct := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadProduct,
+		Secret:  "whsec_test",
+	})
+
+	payloadInvalid := []byte(fmt.Sprintf(`{"id":"evt_dead","object":"event","api_version":"%s","type":"customer.subscription.updated","data":{"object":{"id":"sub_123","object":"subscription"}}}`, stripe.APIVersion))
+	signedInvalid := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payloadInvalid,
+		Secret:  "whsec_test",
+	})
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "stripe webhook acknowledges and queues event",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadProduct),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedProduct.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				previousQueue := stripeEventQueue
+				t.Cleanup(func() { stripeEventQueue = previousQueue })
+				stripeEventQueue = make(chan string, 1)
+				ensureStripeEventCollection(t, app)
+				ensureProductCollection(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_queued")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "pending" {
+					t.Fatalf("Expected stripe event status to be pending, got %s", record.GetString("status"))
+				}
+				if _, err := app.FindFirstRecordByData("product", "product_id", "prod_queued"); err == nil {
+					t.Fatal("Expected product not to be synced before the worker runs")
+				}
+
+				recordId := <-stripeEventQueue
+				if recordId != record.Id {
+					t.Fatalf("Expected queued record id to be %s, got %s", record.Id, recordId)
+				}
+				processQueuedStripeEvent(app, recordId)
+
+				record, err = app.FindRecordById("stripe_event", recordId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "processed" {
+					t.Fatalf("Expected stripe event status to be processed, got %s", record.GetString("status"))
+				}
+				if _, err := app.FindFirstRecordByData("product", "product_id", "prod_queued"); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:           "stripe webhook moves exhausted event to dead letter",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payloadInvalid),
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"missing subscription customer"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signedInvalid.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				previousMaxAttempts := stripeWebhookMaxAttempts
+				t.Cleanup(func() { stripeWebhookMaxAttempts = previousMaxAttempts })
+				stripeWebhookMaxAttempts = 1
+				ensureStripeEventCollection(t, app)
+				ensureStripeDeadLetterCollection(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_dead")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "dead_letter" {
+					t.Fatalf("Expected stripe event status to be dead_letter, got %s", record.GetString("status"))
+				}
+
+				deadLetter, err := app.FindFirstRecordByData("stripe_event_dead_letter", "event_id", "evt_dead")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if deadLetter.GetString("type") != "customer.subscription.updated" {
+					t.Fatalf("Expected dead letter type to be customer.subscription.updated, got %s", deadLetter.GetString("type"))
+				}
+			},
+		},
+	})
+}
+
+func TestStripeEventRetryDelay(t *testing.T) {
+	previousDelay := stripeWebhookRetryDelay
+	t.Cleanup(func() { stripeWebhookRetryDelay = previousDelay })
+	stripeWebhookRetryDelay = 30 * time.Second
+
+	for attempts, expected := range map[int]time.Duration{
+		1:    30 * time.Second,
+		2:    time.Minute,
+		4:    4 * time.Minute,
+		13:   maxStripeEventRetryDelay,
+		64:   maxStripeEventRetryDelay,
+		1000: maxStripeEventRetryDelay,
+	} {
+		if delay := stripeEventRetryDelay(attempts); delay != expected {
+			t.Fatalf("Expected a delay of %s after %d attempts, got %s", expected, attempts, delay)
+		}
+	}
+}
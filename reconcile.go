@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// subscriptionFieldDrift describes a subscription field whose stored value
+// differs from Stripe.
+type subscriptionFieldDrift struct {
+	Field  string `json:"field"`
+	Stored string `json:"stored"`
+	Stripe string `json:"stripe"`
+}
+
+// subscriptionDrift compares the fields of a stored subscription record that
+// matter for access and billing against the Stripe subscription.
+func subscriptionDrift(record *core.Record, subscription *stripe.Subscription) []subscriptionFieldDrift {
+	drift := []subscriptionFieldDrift{}
+
+	compare := func(field, stored, actual string) {
+		if stored != actual {
+			drift = append(drift, subscriptionFieldDrift{Field: field, Stored: stored, Stripe: actual})
+		}
+	}
+	compareDate := func(field string, actual int64) {
+		stored := record.GetDateTime(field)
+		storedUnix := int64(0)
+		if !stored.IsZero() {
+			storedUnix = stored.Time().Unix()
+		}
+		compare(field, int64ToISODate(storedUnix), int64ToISODate(actual))
+	}
+
+	compare("status", record.GetString("status"), string(subscription.Status))
+
+	var priceID string
+	var quantity int64
+	if subscription.Items != nil && len(subscription.Items.Data) > 0 && subscription.Items.Data[0].Price != nil {
+		priceID = subscription.Items.Data[0].Price.ID
+		quantity = subscription.Items.Data[0].Quantity
+	}
+	compare("price_id", record.GetString("price_id"), priceID)
+	compare("quantity", strconv.Itoa(record.GetInt("quantity")), strconv.FormatInt(quantity, 10))
+	compare("cancel_at_period_end", strconv.FormatBool(record.GetBool("cancel_at_period_end")), strconv.FormatBool(subscription.CancelAtPeriodEnd))
+
+	compareDate("current_period_start", subscription.CurrentPeriodStart)
+	compareDate("current_period_end", subscription.CurrentPeriodEnd)
+
+	return drift
+}
+
+// subscriptionRepair lists the drifted fields of a repaired subscription.
+type subscriptionRepair struct {
+	SubscriptionID string                   `json:"subscription_id"`
+	Drift          []subscriptionFieldDrift `json:"drift"`
+}
+
+// reconcileReport summarises what a reconciliation run changed.
+type reconcileReport struct {
+	CustomersCreated      []string             `json:"customers_created"`
+	SubscriptionsCreated  []string             `json:"subscriptions_created"`
+	SubscriptionsRepaired []subscriptionRepair `json:"subscriptions_repaired"`
+	Errors                []string             `json:"errors"`
+}
+
+// reconcileStripeSubscriptions lists every Stripe customer created by this
+// service (those carrying pocketbaseUUID or pocketbaseOrganisationID metadata)
+// together with all of their subscriptions, creates missing customer and
+// subscription rows and repairs subscription rows that drifted from Stripe.
+func reconcileStripeSubscriptions(app core.App) (*reconcileReport, error) {
+	report := &reconcileReport{
+		CustomersCreated:      []string{},
+		SubscriptionsCreated:  []string{},
+		SubscriptionsRepaired: []subscriptionRepair{},
+		Errors:                []string{},
+	}
+
+	customerCollection, err := app.FindCollectionByNameOrId("customer")
+	if err != nil {
+		return report, err
+	}
+
+	// the listed objects are current as of now, so only newer events may
+	// overwrite them afterwards
+	syncedAt := time.Now().Unix()
+
+	customerParams := &stripe.CustomerListParams{}
+	customerParams.Limit = stripe.Int64(100)
+	customers := customer.List(customerParams)
+	for customers.Next() {
+		stripeCustomer := customers.Customer()
+		uuid := stripeCustomer.Metadata["pocketbaseUUID"]
+		organisationID := stripeCustomer.Metadata["pocketbaseOrganisationID"]
+		if uuid == "" && organisationID == "" {
+			continue
+		}
+
+		// create the customer mapping if it is missing
+		if _, err := app.FindFirstRecordByData("customer", "stripe_customer_id", stripeCustomer.ID); err != nil {
+			customerRecord := core.NewRecord(customerCollection)
+			customerRecord.Set("user_id", uuid)
+			customerRecord.Set("organisation_id", organisationID)
+			customerRecord.Set("stripe_customer_id", stripeCustomer.ID)
+			if err := app.Save(customerRecord); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("could not create customer %s: %v", stripeCustomer.ID, err))
+				continue
+			}
+			report.CustomersCreated = append(report.CustomersCreated, stripeCustomer.ID)
+		}
+
+		subscriptionParams := &stripe.SubscriptionListParams{
+			Customer: stripe.String(stripeCustomer.ID),
+			Status:   stripe.String("all"),
+		}
+		subscriptionParams.Limit = stripe.Int64(100)
+		subscriptions := stripeSubscription.List(subscriptionParams)
+		for subscriptions.Next() {
+			subscription := subscriptions.Subscription()
+
+			existingRecord, err := app.FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
+			var drift []subscriptionFieldDrift
+			if err == nil && existingRecord != nil {
+				drift = subscriptionDrift(existingRecord, subscription)
+				if len(drift) == 0 {
+					continue
+				}
+			}
+
+			savedRecord, err := upsertSubscription(app, subscription, syncedAt)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("could not sync subscription %s: %v", subscription.ID, err))
+				continue
+			}
+			// an event newer than the listing already updated the row
+			if savedRecord == nil {
+				continue
+			}
+
+			if existingRecord == nil {
+				report.SubscriptionsCreated = append(report.SubscriptionsCreated, subscription.ID)
+			} else {
+				report.SubscriptionsRepaired = append(report.SubscriptionsRepaired, subscriptionRepair{
+					SubscriptionID: subscription.ID,
+					Drift:          drift,
+				})
+			}
+		}
+		if err := subscriptions.Err(); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("could not list subscriptions of customer %s: %v", stripeCustomer.ID, err))
+		}
+	}
+	if err := customers.Err(); err != nil {
+		return report, fmt.Errorf("could not list stripe customers: %w", err)
+	}
+
+	return report, nil
+}
+
+// runScheduledReconciliation is the cron job version of the reconciliation,
+// which logs its report instead of returning it.
+func runScheduledReconciliation(app core.App) {
+	report, err := reconcileStripeSubscriptions(app)
+	if err != nil {
+		app.Logger().Error("could not reconcile stripe subscriptions", "error", err)
+		return
+	}
+
+	app.Logger().Info(
+		"reconciled stripe subscriptions",
+		"customersCreated", report.CustomersCreated,
+		"subscriptionsCreated", report.SubscriptionsCreated,
+		"subscriptionsRepaired", report.SubscriptionsRepaired,
+		"errors", report.Errors,
+	)
+}
+
+func handleReconcileStripeSubscriptions(e *core.RequestEvent) error {
+	report, err := reconcileStripeSubscriptions(e.App)
+	if err != nil {
+		e.App.Logger().Error("could not reconcile stripe subscriptions", "error", err)
+		return e.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"failure": "could not reconcile stripe subscriptions",
+			"report":  report,
+		})
+	}
+
+	return e.JSON(http.StatusOK, map[string]interface{}{
+		"success": "subscriptions were reconciled",
+		"report":  report,
+	})
+}
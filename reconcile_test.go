@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestReconcileStripeSubscriptionsEndpoint(t *testing.T) {
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "reconcile requires superuser",
+			method:         http.MethodPost,
+			url:            "/stripe/sync/subscriptions",
+			expectedStatus: http.StatusUnauthorized,
+			expectedContent: []string{
+				`"data":{}`,
+			},
+		},
+		{
+			name:           "reconcile creates and repairs rows",
+			method:         http.MethodPost,
+			url:            "/stripe/sync/subscriptions",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"subscriptions were reconciled"`,
+				`"customers_created":["cus_test"]`,
+				`"subscriptions_created":["sub_missing"]`,
+				`"subscription_id":"sub_drifted"`,
+				`{"field":"status","stored":"active","stripe":"canceled"}`,
+				`{"field":"quantity","stored":"1","stripe":"2"}`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setupStripeMock(t)
+				ensureCustomerCollection(t, app)
+				collection := ensureSubscriptionCollection(t, app)
+
+				drifted := core.NewRecord(collection)
+				drifted.Set("subscription_id", "sub_drifted")
+				drifted.Set("user_id", "user_test")
+				drifted.Set("status", "active")
+				drifted.Set("price_id", "price_test")
+				drifted.Set("quantity", 1)
+				drifted.Set("current_period_start", int64ToISODate(1700000000))
+				drifted.Set("current_period_end", int64ToISODate(1702592000))
+				if err := app.Save(drifted); err != nil {
+					t.Fatal(err)
+				}
+
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				customerRecord, err := app.FindFirstRecordByData("customer", "stripe_customer_id", "cus_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if customerRecord.GetString("user_id") != "user_test" {
+					t.Fatalf("Expected customer user_id to be user_test, got %s", customerRecord.GetString("user_id"))
+				}
+				if _, err := app.FindFirstRecordByData("customer", "stripe_customer_id", "cus_other"); err == nil {
+					t.Fatal("Expected customers without pocketbaseUUID to be ignored")
+				}
+
+				missing, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_missing")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if missing.GetString("user_id") != "user_test" {
+					t.Fatalf("Expected subscription user_id to be user_test, got %s", missing.GetString("user_id"))
+				}
+
+				drifted, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_drifted")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if drifted.GetString("status") != "canceled" {
+					t.Fatalf("Expected drifted subscription status to be canceled, got %s", drifted.GetString("status"))
+				}
+				if drifted.GetInt("quantity") != 2 {
+					t.Fatalf("Expected drifted subscription quantity to be 2, got %d", drifted.GetInt("quantity"))
+				}
+			},
+		},
+		{
+			name:           "reconcile doesn't count skipped stale rows as repaired",
+			method:         http.MethodPost,
+			url:            "/stripe/sync/subscriptions",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"subscriptions_repaired":[]`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setupStripeMock(t)
+				ensureCustomerCollection(t, app)
+				collection := ensureSubscriptionCollection(t, app)
+
+				// synced from an event newer than the listing
+				drifted := core.NewRecord(collection)
+				drifted.Set("subscription_id", "sub_drifted")
+				drifted.Set("user_id", "user_test")
+				drifted.Set("status", "active")
+				drifted.Set("price_id", "price_test")
+				drifted.Set("quantity", 1)
+				drifted.Set("last_event_created", int64ToISODate(time.Now().Add(time.Hour).Unix()))
+				if err := app.Save(drifted); err != nil {
+					t.Fatal(err)
+				}
+
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				drifted, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_drifted")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if drifted.GetString("status") != "active" {
+					t.Fatalf("Expected the newer subscription row to be kept, got status %s", drifted.GetString("status"))
+				}
+			},
+		},
+	})
+}
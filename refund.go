@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	stripeCharge "github.com/stripe/stripe-go/v76/charge"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// refund and dispute policies, see STRIPE_REFUND_DISPUTE_POLICY
+const (
+	refundDisputePolicyNone   = "none"
+	refundDisputePolicyFlag   = "flag"
+	refundDisputePolicyRevoke = "revoke"
+)
+
+// billing_flag values set on the user or organisation record
+const (
+	billingFlagRefunded = "refunded"
+	billingFlagDisputed = "disputed"
+)
+
+// chargeLinks holds the records a charge belongs to.
+type chargeLinks struct {
+	userID            string
+	organisationID    string
+	invoiceID         string
+	checkoutSessionID string
+	subscriptionID    string
+}
+
+// findChargeLinks resolves the billing owner, invoice, order and subscription
+// of a charge from the mirrored customer, invoice and order collections.
+func findChargeLinks(app core.App, charge *stripe.Charge) chargeLinks {
+	links := chargeLinks{}
+
+	if charge.Customer != nil {
+		if existingCustomer, err := app.FindFirstRecordByData("customer", "stripe_customer_id", charge.Customer.ID); err == nil {
+			links.userID = existingCustomer.GetString("user_id")
+			links.organisationID = existingCustomer.GetString("organisation_id")
+		}
+	}
+
+	if charge.Invoice != nil {
+		links.invoiceID = charge.Invoice.ID
+		if invoice, err := app.FindFirstRecordByData("invoice", "invoice_id", charge.Invoice.ID); err == nil {
+			links.subscriptionID = invoice.GetString("subscription_id")
+			if links.userID == "" {
+				links.userID = invoice.GetString("user_id")
+			}
+		}
+	}
+
+	if charge.PaymentIntent != nil && charge.PaymentIntent.ID != "" {
+		if order, err := app.FindFirstRecordByData("order", "payment_intent", charge.PaymentIntent.ID); err == nil {
+			links.checkoutSessionID = order.GetString("checkout_session_id")
+			if links.userID == "" {
+				links.userID = order.GetString("user_id")
+			}
+		}
+	}
+
+	return links
+}
+
+// upsertRefundDispute mirrors a refunded charge or a dispute into the
+// refund_dispute collection. kind is either "refund" or "dispute" and
+// stripeID the id of the charge or dispute. See upsertSubscription for the
+// meaning of syncedAt. It returns a nil record when the stored row is newer
+// and the update was skipped.
+func upsertRefundDispute(app core.App, kind, stripeID string, charge *stripe.Charge, links chargeLinks, amount int64, status, reason string, syncedAt int64) (*core.Record, error) {
+	collection, err := app.FindCollectionByNameOrId("refund_dispute")
+	if err != nil {
+		app.Logger().Error("could not find collection refund_dispute", "error", err)
+		return nil, newStripeEventError(http.StatusInternalServerError, "could not find collection refund_dispute", err)
+	}
+
+	existingRecord, err := app.FindFirstRecordByFilter(
+		"refund_dispute",
+		"kind = {:kind} && stripe_id = {:stripeId}",
+		dbx.Params{"kind": kind, "stripeId": stripeID},
+	)
+	var recordToSave *core.Record
+
+	if err == nil && existingRecord != nil {
+		recordToSave = existingRecord
+	} else {
+		recordToSave = core.NewRecord(collection)
+	}
+
+	if isStaleStripeEvent(recordToSave, syncedAt) {
+		app.Logger().Info("skipping stale "+kind+" update", "stripeId", stripeID)
+		return nil, nil
+	}
+
+	recordToSave.Set("kind", kind)
+	recordToSave.Set("stripe_id", stripeID)
+	recordToSave.Set("charge_id", charge.ID)
+	if charge.PaymentIntent != nil {
+		recordToSave.Set("payment_intent", charge.PaymentIntent.ID)
+	}
+	recordToSave.Set("user_id", links.userID)
+	recordToSave.Set("organisation_id", links.organisationID)
+	recordToSave.Set("invoice_id", links.invoiceID)
+	recordToSave.Set("checkout_session_id", links.checkoutSessionID)
+	recordToSave.Set("amount", amount)
+	recordToSave.Set("currency", charge.Currency)
+	recordToSave.Set("status", status)
+	recordToSave.Set("reason", reason)
+	recordToSave.Set("last_event_created", int64ToISODate(syncedAt))
+
+	if err = app.Save(recordToSave); err != nil {
+		app.Logger().Error("could not save "+kind+" record", "stripeId", stripeID, "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "could not save "+kind+" record", err)
+	}
+
+	return recordToSave, nil
+}
+
+// syncChargeRefunded records a refunded charge and applies the refund policy
+// once the charge has been refunded in full.
+func syncChargeRefunded(app core.App, eventSync *stripeEventSync, charge *stripe.Charge, syncedAt int64) error {
+	links := findChargeLinks(app, charge)
+
+	status := "partially_refunded"
+	if charge.Refunded {
+		status = "refunded"
+	}
+
+	record, err := upsertRefundDispute(app, "refund", charge.ID, charge, links, charge.AmountRefunded, status, "", syncedAt)
+	if err != nil || record == nil || !charge.Refunded {
+		return err
+	}
+
+	return applyRefundDisputePolicy(app, eventSync, links, billingFlagRefunded)
+}
+
+// fetchDisputedCharge returns the charge of a dispute. The charge is usually
+// not expanded in the event payload, so it is retrieved from Stripe then.
+func fetchDisputedCharge(app core.App, dispute *stripe.Dispute) (*stripe.Charge, error) {
+	if dispute.Charge == nil {
+		app.Logger().Error("dispute missing charge", "disputeId", dispute.ID)
+		return nil, newStripeEventError(http.StatusBadRequest, "missing dispute charge", nil)
+	}
+	if dispute.Charge.Customer != nil || dispute.Charge.Invoice != nil {
+		return dispute.Charge, nil
+	}
+
+	charge, err := stripeCharge.Get(dispute.Charge.ID, nil)
+	if err != nil {
+		app.Logger().Error("could not retrieve disputed charge", "chargeId", dispute.Charge.ID, "error", err)
+		return nil, newStripeEventError(http.StatusInternalServerError, "could not retrieve disputed charge", err)
+	}
+	return charge, nil
+}
+
+// syncDispute records a dispute of the charge eventSync.disputedCharge.
+// Opening a dispute applies the dispute policy and winning it clears the
+// billing flag again.
+func syncDispute(app core.App, eventSync *stripeEventSync, eventType stripe.EventType, dispute *stripe.Dispute, syncedAt int64) error {
+	charge := eventSync.disputedCharge
+	if charge.PaymentIntent == nil {
+		charge.PaymentIntent = dispute.PaymentIntent
+	}
+	links := findChargeLinks(app, charge)
+
+	record, err := upsertRefundDispute(app, "dispute", dispute.ID, charge, links, dispute.Amount, string(dispute.Status), string(dispute.Reason), syncedAt)
+	if err != nil || record == nil {
+		return err
+	}
+
+	switch {
+	case eventType == "charge.dispute.created":
+		return applyRefundDisputePolicy(app, eventSync, links, billingFlagDisputed)
+	case eventType == "charge.dispute.closed" && dispute.Status == stripe.DisputeStatusWon:
+		return clearBillingFlag(app, links, billingFlagDisputed)
+	}
+
+	return nil
+}
+
+// applyRefundDisputePolicy flags the billing owner, the user or organisation,
+// with billingFlag and, with the revoke policy, also takes away what the
+// payment bought: the order is marked with billingFlag as its status and the
+// subscription is canceled in Stripe once the event is committed.
+func applyRefundDisputePolicy(app core.App, eventSync *stripeEventSync, links chargeLinks, billingFlag string) error {
+	if stripeRefundDisputePolicy == refundDisputePolicyNone {
+		return nil
+	}
+
+	if owner := findChargeOwner(app, links); owner != nil {
+		if err := saveBillingFlag(app, owner.record(), billingFlag); err != nil {
+			return err
+		}
+	}
+
+	if stripeRefundDisputePolicy != refundDisputePolicyRevoke {
+		return nil
+	}
+
+	if links.checkoutSessionID != "" {
+		if order, err := app.FindFirstRecordByData("order", "checkout_session_id", links.checkoutSessionID); err == nil {
+			order.Set("status", billingFlag)
+			if err = app.Save(order); err != nil {
+				app.Logger().Error("could not save order record", "sessionId", links.checkoutSessionID, "error", err)
+				return newStripeEventError(http.StatusBadRequest, "could not save order record", err)
+			}
+		}
+	}
+
+	if links.subscriptionID != "" {
+		subscription, err := app.FindFirstRecordByData("subscription", "subscription_id", links.subscriptionID)
+		if err == nil && subscription.GetString("status") != string(stripe.SubscriptionStatusCanceled) {
+			subscriptionID := links.subscriptionID
+			eventSync.after(func(app core.App) error {
+				// the resulting customer.subscription.deleted event updates the record
+				if _, err := stripeSubscription.Cancel(subscriptionID, nil); err != nil {
+					return fmt.Errorf("could not cancel subscription %s: %w", subscriptionID, err)
+				}
+				return nil
+			})
+		}
+	}
+
+	return nil
+}
+
+// findChargeOwner returns the billing owner of a charge, nil when it can't be
+// found.
+func findChargeOwner(app core.App, links chargeLinks) *billingOwner {
+	owner, err := findBillingOwner(app, links.userID, links.organisationID)
+	if err != nil {
+		return nil
+	}
+	return owner
+}
+
+// saveBillingFlag sets billing_flag on a user or organisation record.
+func saveBillingFlag(app core.App, record *core.Record, billingFlag string) error {
+	record.Set("billing_flag", billingFlag)
+	if err := app.Save(record); err != nil {
+		app.Logger().Error("could not save billing flag", "collection", record.Collection().Name, "id", record.Id, "error", err)
+		return newStripeEventError(http.StatusBadRequest, "couldn't submit billing flag update", err)
+	}
+	return nil
+}
+
+// clearBillingFlag removes billingFlag from the billing owner of a charge when
+// it is still set.
+func clearBillingFlag(app core.App, links chargeLinks, billingFlag string) error {
+	owner := findChargeOwner(app, links)
+	if owner == nil || owner.record().GetString("billing_flag") != billingFlag {
+		return nil
+	}
+	return saveBillingFlag(app, owner.record(), "")
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func ensureRefundDisputeCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("refund_dispute")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("refund_dispute")
+	collection.Fields.Add(
+		&core.SelectField{Name: "kind", Required: true, MaxSelect: 1, Values: []string{"refund", "dispute"}},
+		&core.TextField{Name: "stripe_id", Required: true},
+		&core.TextField{Name: "charge_id"},
+		&core.TextField{Name: "payment_intent"},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "organisation_id"},
+		&core.TextField{Name: "invoice_id"},
+		&core.TextField{Name: "checkout_session_id"},
+		&core.NumberField{Name: "amount", OnlyInt: true},
+		&core.TextField{Name: "currency"},
+		&core.TextField{Name: "status"},
+		&core.TextField{Name: "reason"},
+		&core.DateField{Name: "last_event_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+// ensureUserRecord creates the "user" collection the webhook sync looks users
+// up in, together with a test user record.
+func ensureUserRecord(t testing.TB, app *tests.TestApp) *core.Record {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("user")
+	if err != nil || collection == nil {
+		collection = core.NewBaseCollection("user")
+		collection.Fields.Add(
+			&core.TextField{Name: "email"},
+			&core.TextField{Name: "billing_flag"},
+		)
+		if err := app.Save(collection); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record := core.NewRecord(collection)
+	record.Set("id", "usertest0000000")
+	record.Set("email", "test@example.com")
+	if err := app.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	return record
+}
+
+func TestRefundAndDisputeEvents(t *testing.T) {
+	signedEvent := func(eventID string, eventType string, created int64, object string) (string, string) {
+		payload := []byte(fmt.Sprintf(`{"id":"%s","object":"event","api_version":"%s","created":%d,"type":"%s","data":{"object":%s}}`, eventID, stripe.APIVersion, created, eventType, object))
+		signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+			Payload: payload,
+			Secret:  "whsec_test",
+		})
+		return string(payload), signed.Header
+	}
+
+	refundedBody, refundedHeader := signedEvent("evt_refunded", "charge.refunded", 1700000000, `{"id":"ch_refunded","object":"charge","customer":"cus_test","invoice":"in_refunded","currency":"usd","amount":1000,"amount_refunded":1000,"refunded":true}`)
+	partialBody, partialHeader := signedEvent("evt_partial", "charge.refunded", 1700000000, `{"id":"ch_partial","object":"charge","customer":"cus_test","currency":"usd","amount":1000,"amount_refunded":400,"refunded":false}`)
+	disputeBody, disputeHeader := signedEvent("evt_dispute_created", "charge.dispute.created", 1700000000, `{"id":"dp_test","object":"dispute","charge":"ch_disputed","payment_intent":"pi_test","currency":"usd","amount":5000,"reason":"fraudulent","status":"needs_response"}`)
+	wonBody, wonHeader := signedEvent("evt_dispute_closed", "charge.dispute.closed", 1700000100, `{"id":"dp_test","object":"dispute","charge":"ch_disputed","payment_intent":"pi_test","currency":"usd","amount":5000,"reason":"fraudulent","status":"won"}`)
+
+	orgRefundedBody, orgRefundedHeader := signedEvent("evt_org_refunded", "charge.refunded", 1700000000, `{"id":"ch_org","object":"charge","customer":"cus_org","currency":"usd","amount":1000,"amount_refunded":1000,"refunded":true}`)
+
+	setup := func(t testing.TB, app *tests.TestApp) *core.Record {
+		WHSEC = "whsec_test"
+		setupStripeMock(t)
+		refundedSubscriptionCanceled = false
+		ensureStripeEventCollection(t, app)
+		ensureRefundDisputeCollection(t, app)
+		ensureInvoiceCollection(t, app)
+		ensureOrderCollection(t, app)
+		ensureSubscriptionCollection(t, app)
+		user := ensureUserRecord(t, app)
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", user.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		return user
+	}
+
+	// revokeSetup applies the revoke policy to the refund of an invoice of
+	// the active sub_refunded
+	revokeSetup := func(t testing.TB, app *tests.TestApp) {
+		user := setup(t, app)
+		stripeRefundDisputePolicy = refundDisputePolicyRevoke
+
+		invoice := core.NewRecord(ensureInvoiceCollection(t, app))
+		invoice.Set("invoice_id", "in_refunded")
+		invoice.Set("user_id", user.Id)
+		invoice.Set("subscription_id", "sub_refunded")
+		if err := app.Save(invoice); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_refunded")
+		subscription.Set("status", "active")
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "full refund revokes the subscription with the revoke policy",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           refundedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": refundedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				revokeSetup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				defer func() { stripeRefundDisputePolicy = refundDisputePolicyFlag }()
+
+				if !refundedSubscriptionCanceled {
+					t.Fatal("Expected the refunded subscription to be canceled")
+				}
+
+				refund, err := app.FindFirstRecordByData("refund_dispute", "stripe_id", "ch_refunded")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if refund.GetString("kind") != "refund" || refund.GetString("status") != "refunded" {
+					t.Fatalf("Expected a refunded refund row, got %s %s", refund.GetString("kind"), refund.GetString("status"))
+				}
+				if refund.GetString("invoice_id") != "in_refunded" {
+					t.Fatalf("Expected refund invoice_id to be in_refunded, got %s", refund.GetString("invoice_id"))
+				}
+
+				user, err := app.FindRecordById("user", "usertest0000000")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user.GetString("billing_flag") != billingFlagRefunded {
+					t.Fatalf("Expected user billing_flag to be refunded, got %s", user.GetString("billing_flag"))
+				}
+			},
+		},
+		{
+			name:           "revoke policy doesn't cancel the subscription when the event fails",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           refundedBody,
+			expectedStatus: http.StatusInternalServerError,
+			expectedContent: []string{
+				`"failure":"could not process stripe event"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": refundedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				revokeSetup(t, app)
+				// the ledger record can't be marked as processed, which rolls
+				// back the event's transaction
+				app.OnRecordUpdate("stripe_event").BindFunc(func(e *core.RecordEvent) error {
+					return errors.New("ledger unavailable")
+				})
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				defer func() { stripeRefundDisputePolicy = refundDisputePolicyFlag }()
+
+				if refundedSubscriptionCanceled {
+					t.Fatal("Expected the subscription of a rolled back event to stay active in Stripe")
+				}
+			},
+		},
+		{
+			name:           "full refund of an organisation flags the organisation",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           orgRefundedBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": orgRefundedHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+				organisation := ensureOrganisationRecord(t, app)
+
+				customer := core.NewRecord(ensureCustomerCollection(t, app))
+				customer.Set("organisation_id", organisation.Id)
+				customer.Set("stripe_customer_id", "cus_org")
+				if err := app.Save(customer); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				refund, err := app.FindFirstRecordByData("refund_dispute", "stripe_id", "ch_org")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if refund.GetString("organisation_id") != "orgtest00000000" || refund.GetString("user_id") != "" {
+					t.Fatalf("Expected the refund to belong to the organisation, got %v", refund)
+				}
+
+				organisation, err := app.FindRecordById("organisation", "orgtest00000000")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if organisation.GetString("billing_flag") != billingFlagRefunded {
+					t.Fatalf("Expected organisation billing_flag to be refunded, got %s", organisation.GetString("billing_flag"))
+				}
+			},
+		},
+		{
+			name:           "partial refund is recorded without flagging the user",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           partialBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": partialHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				refund, err := app.FindFirstRecordByData("refund_dispute", "stripe_id", "ch_partial")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if refund.GetString("status") != "partially_refunded" || refund.GetInt("amount") != 400 {
+					t.Fatalf("Expected a partial refund of 400, got %s %d", refund.GetString("status"), refund.GetInt("amount"))
+				}
+
+				user, err := app.FindRecordById("user", "usertest0000000")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user.GetString("billing_flag") != "" {
+					t.Fatalf("Expected user billing_flag to be empty, got %s", user.GetString("billing_flag"))
+				}
+			},
+		},
+		{
+			name:           "opened dispute flags the user and links the order",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           disputeBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": disputeHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				user := setup(t, app)
+
+				order := core.NewRecord(ensureOrderCollection(t, app))
+				order.Set("checkout_session_id", "cs_payment")
+				order.Set("payment_intent", "pi_test")
+				order.Set("user_id", user.Id)
+				order.Set("status", "paid")
+				if err := app.Save(order); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				dispute, err := app.FindFirstRecordByData("refund_dispute", "stripe_id", "dp_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dispute.GetString("checkout_session_id") != "cs_payment" {
+					t.Fatalf("Expected dispute to be linked to cs_payment, got %s", dispute.GetString("checkout_session_id"))
+				}
+				if dispute.GetString("reason") != "fraudulent" {
+					t.Fatalf("Expected dispute reason to be fraudulent, got %s", dispute.GetString("reason"))
+				}
+
+				user, err := app.FindRecordById("user", "usertest0000000")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user.GetString("billing_flag") != billingFlagDisputed {
+					t.Fatalf("Expected user billing_flag to be disputed, got %s", user.GetString("billing_flag"))
+				}
+
+				// the flag policy leaves the order alone
+				order, err := app.FindFirstRecordByData("order", "checkout_session_id", "cs_payment")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if order.GetString("status") != "paid" {
+					t.Fatalf("Expected order status to stay paid, got %s", order.GetString("status"))
+				}
+			},
+		},
+		{
+			name:           "won dispute clears the billing flag",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           wonBody,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": wonHeader,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				user := setup(t, app)
+				user.Set("billing_flag", billingFlagDisputed)
+				if err := app.Save(user); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				dispute, err := app.FindFirstRecordByData("refund_dispute", "stripe_id", "dp_test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dispute.GetString("status") != "won" {
+					t.Fatalf("Expected dispute status to be won, got %s", dispute.GetString("status"))
+				}
+
+				user, err := app.FindRecordById("user", "usertest0000000")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user.GetString("billing_flag") != "" {
+					t.Fatalf("Expected user billing_flag to be cleared, got %s", user.GetString("billing_flag"))
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// replayStripeEvent re-runs the webhook sync logic for a stored event,
+// regardless of its current status. With syncOnly only the database is synced
+// and side effects such as reminder emails are skipped. A successfully
+// replayed dead letter is removed from the dead-letter collection.
+func replayStripeEvent(app core.App, record *core.Record, syncOnly bool) error {
+	if _, loaded := stripeEventsInFlight.LoadOrStore(record.Id, struct{}{}); loaded {
+		return errors.New("event is already being processed")
+	}
+	defer stripeEventsInFlight.Delete(record.Id)
+
+	event, err := stripeEventFromRecord(record)
+	if err != nil {
+		return fmt.Errorf("could not decode stored stripe event: %w", err)
+	}
+
+	if err = processStripeEvent(app, record, event, syncOnly); err != nil {
+		return err
+	}
+
+	deadLetter, err := app.FindFirstRecordByData("stripe_event_dead_letter", "event_id", event.ID)
+	if err == nil && deadLetter != nil {
+		if err = app.Delete(deadLetter); err != nil {
+			app.Logger().Error("could not delete stripe dead letter record", "eventId", event.ID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// findStripeEventsToReplay returns the stored events created within the given
+// range (zero bounds are open) and, optionally, only those in the dead-letter
+// state. Events are returned oldest first so they are replayed in order.
+func findStripeEventsToReplay(app core.App, from, to types.DateTime, deadLetterOnly bool) ([]*core.Record, error) {
+	filter := "id != ''"
+	params := dbx.Params{}
+
+	if !from.IsZero() {
+		filter += " && event_created >= {:from}"
+		params["from"] = from.String()
+	}
+	if !to.IsZero() {
+		filter += " && event_created <= {:to}"
+		params["to"] = to.String()
+	}
+	if deadLetterOnly {
+		filter += " && status = {:status}"
+		params["status"] = stripeEventStatusDeadLetter
+	}
+
+	return app.FindRecordsByFilter("stripe_event", filter, "event_created", 0, 0, params)
+}
+
+// replayStripeEvents replays every event in records and returns how many
+// succeeded. Failures are logged and recorded on the ledger records.
+func replayStripeEvents(app core.App, records []*core.Record, syncOnly bool) int {
+	replayed := 0
+	for _, record := range records {
+		if err := replayStripeEvent(app, record, syncOnly); err != nil {
+			app.Logger().Error("could not replay stripe event", "eventId", record.GetString("event_id"), "error", err)
+			continue
+		}
+		replayed++
+	}
+	return replayed
+}
+
+func handleReplayStripeEvent(e *core.RequestEvent) error {
+	eventID := e.Request.PathValue("id")
+
+	data, err := readRequestBody(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+	syncOnly, _ := data["sync_only"].(bool)
+
+	record, err := e.App.FindFirstRecordByData("stripe_event", "event_id", eventID)
+	if err != nil {
+		e.App.Logger().Error("could not find stripe event", "eventId", eventID, "error", err)
+		return e.JSON(http.StatusNotFound, map[string]string{"failure": "could not find stripe event"})
+	}
+
+	if err = replayStripeEvent(e.App, record, syncOnly); err != nil {
+		var eventErr *stripeEventError
+		if errors.As(err, &eventErr) {
+			return e.JSON(eventErr.status, map[string]string{"failure": eventErr.failure})
+		}
+		return e.JSON(http.StatusInternalServerError, map[string]string{"failure": err.Error()})
+	}
+
+	return e.JSON(http.StatusOK, map[string]interface{}{"success": "event was replayed"})
+}
+
+func handleReplayStripeEvents(e *core.RequestEvent) error {
+	// 1. destructure the range, dead letter and sync only flags from the POST body
+	data, err := readRequestBody(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+
+	var from, to types.DateTime
+	if value, ok := data["from"].(string); ok && value != "" {
+		if from, err = types.ParseDateTime(value); err != nil {
+			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid from date"})
+		}
+	}
+	if value, ok := data["to"].(string); ok && value != "" {
+		if to, err = types.ParseDateTime(value); err != nil {
+			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid to date"})
+		}
+	}
+	deadLetterOnly, _ := data["dead_letter"].(bool)
+	syncOnly, _ := data["sync_only"].(bool)
+
+	if from.IsZero() && to.IsZero() && !deadLetterOnly {
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "a date range or dead_letter is required"})
+	}
+
+	// 2. replay the matching events in order
+	records, err := findStripeEventsToReplay(e.App, from, to, deadLetterOnly)
+	if err != nil {
+		e.App.Logger().Error("could not find stripe events to replay", "error", err)
+		return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "could not find stripe events"})
+	}
+
+	replayed := replayStripeEvents(e.App, records, syncOnly)
+
+	return e.JSON(http.StatusOK, map[string]interface{}{
+		"success":  "events were replayed",
+		"total":    len(records),
+		"replayed": replayed,
+		"failed":   len(records) - replayed,
+	})
+}
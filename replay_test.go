@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/stripe/stripe-go/v76"
+)
+
+func superuserTokenForTest(t testing.TB, app *tests.TestApp) string {
+	t.Helper()
+
+	superuser, err := app.FindAuthRecordByEmail(core.CollectionNameSuperusers, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := superuser.NewAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func saveStoredStripeEvent(t testing.TB, app *tests.TestApp, eventID, status, payload string) *core.Record {
+	t.Helper()
+
+	collection := ensureStripeEventCollection(t, app)
+	record := core.NewRecord(collection)
+	record.Set("event_id", eventID)
+	record.Set("type", "product.created")
+	record.Set("status", status)
+	record.Set("event_created", int64ToISODate(1700000000))
+	record.Set("payload", types.JSONRaw(payload))
+	if err := app.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	return record
+}
+
+func TestReplayStripeEventEndpoints(t *testing.T) {
+	payloadProduct := fmt.Sprintf(`{"id":"evt_replay","object":"event","api_version":"%s","created":1700000000,"type":"product.created","data":{"object":{"id":"prod_replay","object":"product","active":true,"name":"Replayed product"}}}`, stripe.APIVersion)
+
+	payloadTrial := fmt.Sprintf(`{"id":"evt_trial_replay","object":"event","api_version":"%s","created":1700000000,"type":"customer.subscription.trial_will_end","data":{"object":{"id":"sub_trial","object":"subscription","customer":"cus_test","status":"trialing","trial_end":1700259200,"items":{"object":"list","data":[{"id":"si_trial","object":"subscription_item","quantity":2,"price":{"id":"price_test","object":"price"}}]}}}}`, stripe.APIVersion)
+
+	// trialSetup stores a processed trial_will_end event of a subscription of
+	// the test user, whose reminder email is a side effect of the event
+	trialSetup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+		setupStripeMock(t)
+		ensureSentReminderCollection(t, app)
+		user := ensureUserRecord(t, app)
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", user.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_trial")
+		subscription.Set("user_id", user.Id)
+		subscription.Set("price_id", "price_test")
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		record := saveStoredStripeEvent(t, app, "evt_trial_replay", "processed", payloadTrial)
+		record.Set("type", "customer.subscription.trial_will_end")
+		if err := app.Save(record); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": superuserTokenForTest(t, app),
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "replay requires superuser",
+			method:         http.MethodPost,
+			url:            "/stripe/events/evt_replay/replay",
+			expectedStatus: http.StatusUnauthorized,
+			expectedContent: []string{
+				`"data":{}`,
+			},
+		},
+		{
+			name:           "replay unknown event",
+			method:         http.MethodPost,
+			url:            "/stripe/events/evt_missing/replay",
+			expectedStatus: http.StatusNotFound,
+			expectedContent: []string{
+				`"failure":"could not find stripe event"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				ensureStripeEventCollection(t, app)
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+		},
+		{
+			name:           "replay processed event",
+			method:         http.MethodPost,
+			url:            "/stripe/events/evt_replay/replay",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"event was replayed"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				ensureProductCollection(t, app)
+				saveStoredStripeEvent(t, app, "evt_replay", "processed", payloadProduct)
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("product", "product_id", "prod_replay")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("name") != "Replayed product" {
+					t.Fatalf("Expected product name to be Replayed product, got %s", record.GetString("name"))
+				}
+			},
+		},
+		{
+			name:           "replay skips a reminder that was already sent",
+			method:         http.MethodPost,
+			url:            "/stripe/events/evt_trial_replay/replay",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"event was replayed"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				trialSetup(t, app, scenario)
+				saveSentReminder(t, app, "trial_will_end:sub_trial:1700259200")
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected the reminder not to be sent again, got %d emails", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "sync only replay skips side effects",
+			method:         http.MethodPost,
+			url:            "/stripe/events/evt_trial_replay/replay",
+			body:           `{"sync_only":true}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"event was replayed"`,
+			},
+			setup: trialSetup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected no reminder email, got %d", app.TestMailer.TotalSend())
+				}
+				if _, err := app.FindFirstRecordByData("sent_reminder", "key", "trial_will_end:sub_trial:1700259200"); err == nil {
+					t.Fatal("Expected no reminder to be recorded as sent")
+				}
+				record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_trial")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "trialing" || record.GetInt("quantity") != 2 {
+					t.Fatalf("Expected the subscription to be synced, got %v", record)
+				}
+			},
+		},
+		{
+			name:           "sync only range replay skips side effects",
+			method:         http.MethodPost,
+			url:            "/stripe/events/replay",
+			body:           `{"from":"2023-11-01 00:00:00.000Z","sync_only":true}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"total":1`,
+				`"replayed":1`,
+			},
+			setup: trialSetup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if app.TestMailer.TotalSend() != 0 {
+					t.Fatalf("Expected no reminder email, got %d", app.TestMailer.TotalSend())
+				}
+			},
+		},
+		{
+			name:           "replay range requires a filter",
+			method:         http.MethodPost,
+			url:            "/stripe/events/replay",
+			body:           `{}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"a date range or dead_letter is required"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+		},
+		{
+			name:           "replay dead letters",
+			method:         http.MethodPost,
+			url:            "/stripe/events/replay",
+			body:           `{"dead_letter":true}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"total":1`,
+				`"replayed":1`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				ensureProductCollection(t, app)
+				saveStoredStripeEvent(t, app, "evt_replay", "dead_letter", payloadProduct)
+				saveStoredStripeEvent(t, app, "evt_other", "processed", `{}`)
+
+				deadLetterCollection := ensureStripeDeadLetterCollection(t, app)
+				deadLetter := core.NewRecord(deadLetterCollection)
+				deadLetter.Set("event_id", "evt_replay")
+				if err := app.Save(deadLetter); err != nil {
+					t.Fatal(err)
+				}
+
+				scenario.Headers = map[string]string{
+					"Authorization": superuserTokenForTest(t, app),
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record, err := app.FindFirstRecordByData("stripe_event", "event_id", "evt_replay")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("status") != "processed" {
+					t.Fatalf("Expected stripe event status to be processed, got %s", record.GetString("status"))
+				}
+				if _, err := app.FindFirstRecordByData("stripe_event_dead_letter", "event_id", "evt_replay"); err == nil {
+					t.Fatal("Expected dead letter record to be removed")
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// requestError carries the HTTP status and failure message that is reported
+// back to the client when a request can't be handled.
+type requestError struct {
+	status  int
+	failure string
+}
+
+func (e *requestError) Error() string {
+	return e.failure
+}
+
+// respondRequestError reports err to the client, as its own status and
+// failure when it is a requestError.
+func respondRequestError(e *core.RequestEvent, err error) error {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return e.JSON(reqErr.status, map[string]string{"failure": reqErr.failure})
+	}
+	e.App.Logger().Error("could not handle request", "error", err)
+	return e.JSON(http.StatusInternalServerError, map[string]string{"failure": "something went wrong"})
+}
+
+// readRequestBody reads the JSON object in the request body. An empty body is
+// read as an empty object.
+func readRequestBody(e *core.RequestEvent) (map[string]interface{}, error) {
+	payload, err := io.ReadAll(e.Request.Body)
+	if err != nil {
+		e.App.Logger().Error("could not read request body", "error", err)
+		return nil, &requestError{http.StatusBadRequest, "could not read request body"}
+	}
+	data := map[string]interface{}{}
+	if len(payload) == 0 {
+		return data, nil
+	}
+	if err = json.Unmarshal(payload, &data); err != nil {
+		e.App.Logger().Error("could not parse request body", "error", err)
+		return nil, &requestError{http.StatusBadRequest, "could not parse request body"}
+	}
+	return data, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/coupon"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// cancellationFeedbacks are the reasons for canceling Stripe accepts from
+// customers.
+var cancellationFeedbacks = map[stripe.SubscriptionCancellationDetailsFeedback]bool{
+	stripe.SubscriptionCancellationDetailsFeedbackCustomerService: true,
+	stripe.SubscriptionCancellationDetailsFeedbackLowQuality:      true,
+	stripe.SubscriptionCancellationDetailsFeedbackMissingFeatures: true,
+	stripe.SubscriptionCancellationDetailsFeedbackOther:           true,
+	stripe.SubscriptionCancellationDetailsFeedbackSwitchedService: true,
+	stripe.SubscriptionCancellationDetailsFeedbackTooComplex:      true,
+	stripe.SubscriptionCancellationDetailsFeedbackTooExpensive:    true,
+	stripe.SubscriptionCancellationDetailsFeedbackUnused:          true,
+}
+
+// parseCancellationDetails reads the optional "feedback" and "comment" of a
+// cancel request. Both are nil when not given.
+func parseCancellationDetails(data map[string]interface{}) (*string, *string, error) {
+	var feedback, comment *string
+
+	if rawFeedback, ok := data["feedback"]; ok {
+		value, _ := rawFeedback.(string)
+		if !cancellationFeedbacks[stripe.SubscriptionCancellationDetailsFeedback(value)] {
+			return nil, nil, &requestError{http.StatusBadRequest, "invalid feedback"}
+		}
+		feedback = stripe.String(value)
+	}
+	if rawComment, ok := data["comment"]; ok {
+		value, ok := rawComment.(string)
+		if !ok {
+			return nil, nil, &requestError{http.StatusBadRequest, "invalid comment"}
+		}
+		comment = stripe.String(value)
+	}
+
+	return feedback, comment, nil
+}
+
+// retentionOfferAvailable reports whether the STRIPE_RETENTION_COUPON can be
+// offered for a subscription: it must still be running and may only accept the
+// offer once.
+func retentionOfferAvailable(record *core.Record) bool {
+	if stripeRetentionCoupon == "" || !record.GetDateTime("retention_offer_accepted_at").IsZero() {
+		return false
+	}
+
+	switch stripe.SubscriptionStatus(record.GetString("status")) {
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing, stripe.SubscriptionStatusPastDue:
+		return true
+	}
+	return false
+}
+
+// handleRetentionOffer returns the discount the cancel flow can offer the
+// user before they confirm canceling their subscription.
+func handleRetentionOffer(e *core.RequestEvent) error {
+	_, record, err := readSubscriptionRequest(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+
+	if !retentionOfferAvailable(record) {
+		return e.JSON(http.StatusOK, map[string]any{"available": false})
+	}
+
+	offer, err := coupon.Get(stripeRetentionCoupon, nil)
+	if err != nil || !offer.Valid {
+		e.App.Logger().Error("could not get retention coupon", "couponId", stripeRetentionCoupon, "error", err)
+		return e.JSON(http.StatusOK, map[string]any{"available": false})
+	}
+
+	return e.JSON(http.StatusOK, map[string]any{
+		"available":          true,
+		"subscription_id":    record.GetString("subscription_id"),
+		"coupon_id":          offer.ID,
+		"name":               offer.Name,
+		"percent_off":        offer.PercentOff,
+		"amount_off":         offer.AmountOff,
+		"currency":           offer.Currency,
+		"duration":           offer.Duration,
+		"duration_in_months": offer.DurationInMonths,
+	})
+}
+
+// handleAcceptRetentionOffer applies the retention coupon to the user's
+// subscription and undoes a scheduled cancellation.
+func handleAcceptRetentionOffer(e *core.RequestEvent) error {
+	_, record, err := readSubscriptionRequest(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+	subscriptionID := record.GetString("subscription_id")
+
+	if !retentionOfferAvailable(record) {
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "retention offer is not available"})
+	}
+
+	subscription, err := stripeSubscription.Update(subscriptionID, &stripe.SubscriptionParams{
+		Coupon:            stripe.String(stripeRetentionCoupon),
+		CancelAtPeriodEnd: stripe.Bool(false),
+	})
+	if err != nil {
+		e.App.Logger().Error("could not apply retention coupon", "subscriptionId", subscriptionID, "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not apply retention offer"})
+	}
+
+	record.Set("retention_offer_accepted_at", time.Now().UTC().Format(time.RFC3339))
+	if err = e.App.Save(record); err != nil {
+		e.App.Logger().Error("could not save retention offer", "subscriptionId", subscriptionID, "error", err)
+	}
+
+	return respondManagedSubscription(e, subscription)
+}
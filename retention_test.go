@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func TestCancellationDetails(t *testing.T) {
+	payload := []byte(fmt.Sprintf(`{"id":"evt_portal_cancel","object":"event","api_version":"%s","created":1700000000,"type":"customer.subscription.updated","data":{"object":{"id":"sub_plan","object":"subscription","customer":"cus_test","status":"active","cancel_at_period_end":true,"cancellation_details":{"reason":"cancellation_requested","feedback":"too_expensive","comment":"Can't afford it right now"},"items":{"object":"list","data":[{"id":"si_plan","object":"subscription_item","quantity":1,"price":{"id":"price_base","object":"price"}}]}}}}`, stripe.APIVersion))
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  "whsec_test",
+	})
+
+	setup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+		WHSEC = "whsec_test"
+		setupStripeMock(t)
+		ensureStripeEventCollection(t, app)
+
+		user, token := authTokenForTestUser(t, app)
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", user.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_plan")
+		subscription.Set("user_id", user.Id)
+		subscription.Set("price_id", "price_base")
+		subscription.Set("status", "active")
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+
+	assertDetails := func(t testing.TB, app *tests.TestApp, feedback, comment string) {
+		record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_plan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.GetString("cancellation_reason") != "cancellation_requested" {
+			t.Fatalf("Expected cancellation_reason to be cancellation_requested, got %q", record.GetString("cancellation_reason"))
+		}
+		if record.GetString("cancellation_feedback") != feedback || record.GetString("cancellation_comment") != comment {
+			t.Fatalf("Expected cancellation feedback %q %q, got %q %q", feedback, comment, record.GetString("cancellation_feedback"), record.GetString("cancellation_comment"))
+		}
+	}
+
+	// applySubscriptionRules protects the subscription collection with the
+	// rules of the bootstrap schema
+	applySubscriptionRules := func(t testing.TB, app *tests.TestApp) {
+		ensureOrganisationMemberCollection(t, app)
+		collection := ensureSubscriptionCollection(t, app)
+		listRule, viewRule := bootstrapSchemaRules(t, "subscription")
+		collection.ListRule = &listRule
+		collection.ViewRule = &viewRule
+		if err := app.Save(collection); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "users list their own cancellation details",
+			method:         http.MethodGet,
+			url:            "/api/collections/subscription/records",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"totalItems":1`,
+				`"subscription_id":"sub_plan"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario)
+				applySubscriptionRules(t, app)
+			},
+		},
+		{
+			name:           "cancel stores the feedback",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			body:           `{"feedback":"missing_features","comment":"No dark mode"}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"cancel_at_period_end":true`,
+			},
+			setup: setup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				assertDetails(t, app, "missing_features", "No dark mode")
+			},
+		},
+		{
+			name:           "cancel immediately stores the feedback",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			body:           `{"immediately":true,"feedback":"unused"}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"status":"canceled"`,
+			},
+			setup: setup,
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				assertDetails(t, app, "unused", "")
+			},
+		},
+		{
+			name:           "cancel rejects unknown feedback",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			body:           `{"feedback":"bored"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"invalid feedback"`,
+			},
+			setup: setup,
+		},
+		{
+			name:           "portal cancellation details are synced",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payload),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario)
+				scenario.Headers = map[string]string{
+					"Stripe-Signature": signed.Header,
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				assertDetails(t, app, "too_expensive", "Can't afford it right now")
+			},
+		},
+		{
+			name:           "cancellation comments aren't listed to other users",
+			method:         http.MethodGet,
+			url:            "/api/collections/subscription/records",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"totalItems":0`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario)
+				applySubscriptionRules(t, app)
+
+				record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_plan")
+				if err != nil {
+					t.Fatal(err)
+				}
+				record.Set("user_id", "someoneelse0000")
+				record.Set("cancellation_comment", "Too expensive for us")
+				if err := app.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	})
+}
+
+func TestRetentionOffer(t *testing.T) {
+	setup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario, accepted bool) {
+		setupStripeMock(t)
+		stripeRetentionCoupon = "co_retain"
+
+		user, token := authTokenForTestUser(t, app)
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", user.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_plan")
+		subscription.Set("user_id", user.Id)
+		subscription.Set("price_id", "price_base")
+		subscription.Set("status", "active")
+		subscription.Set("cancel_at_period_end", true)
+		if accepted {
+			subscription.Set("retention_offer_accepted_at", "2023-11-01T00:00:00Z")
+		}
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+	reset := func(t testing.TB, app *tests.TestApp, res *http.Response) {
+		stripeRetentionCoupon = ""
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "retention offer shows the coupon",
+			method:         http.MethodPost,
+			url:            "/retention-offer",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"available":true`,
+				`"coupon_id":"co_retain"`,
+				`"percent_off":50`,
+				`"duration_in_months":3`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, false)
+			},
+			after: reset,
+		},
+		{
+			name:           "retention offer without a coupon configured",
+			method:         http.MethodPost,
+			url:            "/retention-offer",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"available":false`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, false)
+				stripeRetentionCoupon = ""
+			},
+		},
+		{
+			name:           "accepting the offer keeps the subscription",
+			method:         http.MethodPost,
+			url:            "/accept-retention-offer",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"cancel_at_period_end":false`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, false)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				defer reset(t, app, res)
+
+				record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_plan")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetDateTime("retention_offer_accepted_at").IsZero() {
+					t.Fatal("Expected retention_offer_accepted_at to be set")
+				}
+			},
+		},
+		{
+			name:           "offer can only be accepted once",
+			method:         http.MethodPost,
+			url:            "/accept-retention-offer",
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"retention offer is not available"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, true)
+			},
+			after: reset,
+		},
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// upsertSubscription mirrors a Stripe subscription into the subscription
+// collection, linking it to the user through the customer mapping table. The
+// first item is stored as the subscription's price_id and quantity, and every
+// item is also mirrored into the subscription_item collection.
+// syncedAt is the creation time of the event (or the time of the API read)
+// the subscription comes from. It returns a nil record when the stored
+// subscription is newer and the update was skipped. A syncedAt of 0 stores a
+// subscription returned by one of our own API calls: it is always written
+// but leaves last_event_created alone, so the events that follow the call
+// still apply.
+func upsertSubscription(app core.App, subscription *stripe.Subscription, syncedAt int64) (*core.Record, error) {
+	// get customer's UUID from mapping table
+	if subscription.Customer == nil {
+		app.Logger().Error("subscription missing customer")
+		return nil, newStripeEventError(http.StatusBadRequest, "missing subscription customer", nil)
+	}
+	if subscription.Items == nil || len(subscription.Items.Data) == 0 || subscription.Items.Data[0].Price == nil {
+		app.Logger().Error("subscription has no items or price is nil")
+		return nil, newStripeEventError(http.StatusBadRequest, "subscription has no items", nil)
+	}
+	item := subscription.Items.Data[0]
+
+	existingCustomer, err := app.FindFirstRecordByData("customer", "stripe_customer_id", subscription.Customer.ID)
+	if err != nil {
+		app.Logger().Error("could not find customer record for subscription", "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "no customer", err)
+	}
+
+	uuid := existingCustomer.GetString("user_id")
+	collection, err := app.FindCollectionByNameOrId("subscription")
+	if err != nil {
+		app.Logger().Error("could not find collection subscription", "error", err)
+		return nil, newStripeEventError(http.StatusInternalServerError, "collection doesn't exist", err)
+	}
+
+	// update Subscription Details
+	existingRecord, err := app.FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
+	var recordToSave *core.Record
+
+	if err == nil && existingRecord != nil {
+		recordToSave = existingRecord
+	} else {
+		recordToSave = core.NewRecord(collection)
+	}
+
+	if syncedAt > 0 && isStaleStripeEvent(recordToSave, syncedAt) {
+		app.Logger().Info("skipping stale subscription update", "subscriptionId", subscription.ID)
+		return nil, nil
+	}
+
+	recordToSave.Set("subscription_id", subscription.ID)
+	recordToSave.Set("user_id", uuid)
+	recordToSave.Set("organisation_id", existingCustomer.GetString("organisation_id"))
+	recordToSave.Set("metadata", subscription.Metadata)
+	recordToSave.Set("status", subscription.Status)
+	recordToSave.Set("price_id", item.Price.ID)
+	recordToSave.Set("quantity", item.Quantity)
+	recordToSave.Set("cancel_at_period_end", subscription.CancelAtPeriodEnd)
+	recordToSave.Set("cancel_at", int64ToISODate(subscription.CancelAt))
+	recordToSave.Set("canceled_at", int64ToISODate(subscription.CanceledAt))
+	recordToSave.Set("current_period_start", int64ToISODate(subscription.CurrentPeriodStart))
+	recordToSave.Set("current_period_end", int64ToISODate(subscription.CurrentPeriodEnd))
+	recordToSave.Set("created", int64ToISODate(item.Created))
+	recordToSave.Set("ended_at", int64ToISODate(subscription.EndedAt))
+	recordToSave.Set("trial_start", int64ToISODate(subscription.TrialStart))
+	recordToSave.Set("trial_end", int64ToISODate(subscription.TrialEnd))
+	recordToSave.Set("cancellation_reason", "")
+	recordToSave.Set("cancellation_feedback", "")
+	recordToSave.Set("cancellation_comment", "")
+	if subscription.CancellationDetails != nil {
+		recordToSave.Set("cancellation_reason", subscription.CancellationDetails.Reason)
+		recordToSave.Set("cancellation_feedback", subscription.CancellationDetails.Feedback)
+		recordToSave.Set("cancellation_comment", subscription.CancellationDetails.Comment)
+	}
+	recordToSave.Set("pause_behavior", "")
+	recordToSave.Set("pause_resumes_at", "")
+	if subscription.PauseCollection != nil {
+		recordToSave.Set("pause_behavior", subscription.PauseCollection.Behavior)
+		if subscription.PauseCollection.ResumesAt > 0 {
+			recordToSave.Set("pause_resumes_at", int64ToISODate(subscription.PauseCollection.ResumesAt))
+		}
+	}
+	if syncedAt > 0 {
+		recordToSave.Set("last_event_created", int64ToISODate(syncedAt))
+	}
+	setSubscriptionAccess(recordToSave)
+
+	if err = app.Save(recordToSave); err != nil {
+		app.Logger().Error("could not save subscription record", "error", err)
+		return nil, newStripeEventError(http.StatusBadRequest, "couldn't submit subscription update", err)
+	}
+
+	if err = syncSubscriptionItems(app, subscription, uuid); err != nil {
+		return nil, err
+	}
+
+	return recordToSave, nil
+}
+
+// syncSubscriptionItems mirrors every item of a subscription into the
+// subscription_item collection and deletes the items that were removed from
+// the subscription.
+func syncSubscriptionItems(app core.App, subscription *stripe.Subscription, uuid string) error {
+	collection, err := app.FindCollectionByNameOrId("subscription_item")
+	if err != nil {
+		app.Logger().Error("could not find collection subscription_item", "error", err)
+		return newStripeEventError(http.StatusInternalServerError, "could not find collection subscription_item", err)
+	}
+
+	itemIDs := map[string]bool{}
+	for _, item := range subscription.Items.Data {
+		itemIDs[item.ID] = true
+
+		existingRecord, err := app.FindFirstRecordByData("subscription_item", "item_id", item.ID)
+		var recordToSave *core.Record
+
+		if err == nil && existingRecord != nil {
+			recordToSave = existingRecord
+		} else {
+			recordToSave = core.NewRecord(collection)
+		}
+
+		recordToSave.Set("item_id", item.ID)
+		recordToSave.Set("subscription_id", subscription.ID)
+		recordToSave.Set("user_id", uuid)
+		if item.Price != nil {
+			recordToSave.Set("price_id", item.Price.ID)
+			if item.Price.Product != nil {
+				recordToSave.Set("product_id", item.Price.Product.ID)
+			}
+		}
+		recordToSave.Set("quantity", item.Quantity)
+		recordToSave.Set("metadata", item.Metadata)
+		recordToSave.Set("item_created", int64ToISODate(item.Created))
+
+		if err = app.Save(recordToSave); err != nil {
+			app.Logger().Error("could not save subscription item record", "itemId", item.ID, "error", err)
+			return newStripeEventError(http.StatusBadRequest, "couldn't submit subscription item update", err)
+		}
+	}
+
+	// only a complete item list tells which items were removed
+	if subscription.Items.HasMore {
+		return nil
+	}
+
+	existingItems, err := app.FindAllRecords("subscription_item", dbx.HashExp{"subscription_id": subscription.ID})
+	if err != nil {
+		return newStripeEventError(http.StatusInternalServerError, "could not find subscription items", err)
+	}
+	for _, existingItem := range existingItems {
+		if itemIDs[existingItem.GetString("item_id")] {
+			continue
+		}
+		if err = app.Delete(existingItem); err != nil {
+			app.Logger().Error("could not delete subscription item record", "itemId", existingItem.GetString("item_id"), "error", err)
+			return newStripeEventError(http.StatusInternalServerError, "couldn't delete subscription item", err)
+		}
+	}
+
+	return nil
+}
+
+// setSubscriptionAccess sets whether a subscription record grants access:
+// active, trialing and past_due subscriptions do, past_due ones until dunning
+// cancels them, as long as their checkout payment isn't pending.
+func setSubscriptionAccess(record *core.Record) {
+	switch stripe.SubscriptionStatus(record.GetString("status")) {
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing, stripe.SubscriptionStatusPastDue:
+		record.Set("access", !record.GetBool("payment_pending"))
+	default:
+		record.Set("access", false)
+	}
+}
+
+// backfillSubscriptionAccess sets access on the stored subscriptions that
+// were synced before the field existed, or whose access is otherwise out of
+// date, and returns how many were updated.
+func backfillSubscriptionAccess(app core.App) (int, error) {
+	records, err := app.FindAllRecords("subscription")
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, record := range records {
+		access := record.GetBool("access")
+		setSubscriptionAccess(record)
+		if record.GetBool("access") == access {
+			continue
+		}
+		if err = app.Save(record); err != nil {
+			return updated, fmt.Errorf("could not save access of subscription %s: %w", record.GetString("subscription_id"), err)
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+// updateUserPaymentDetails copies the billing address and payment method of
+// the subscription's default payment method onto the user record.
+func updateUserPaymentDetails(app core.App, uuid string, subscription *stripe.Subscription) error {
+	existingUserRecord, err := app.FindFirstRecordByData("user", "id", uuid)
+	if err != nil || existingUserRecord == nil || subscription.DefaultPaymentMethod == nil {
+		return nil
+	}
+
+	if subscription.DefaultPaymentMethod.Customer != nil {
+		existingUserRecord.Set("billing_address", subscription.DefaultPaymentMethod.Customer.Address)
+	}
+	existingUserRecord.Set("payment_method", subscription.DefaultPaymentMethod.Type)
+
+	if err = app.Save(existingUserRecord); err != nil {
+		app.Logger().Error("could not save user record", "userId", uuid, "error", err)
+		return newStripeEventError(http.StatusBadRequest, "couldn't submit user update", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// readSubscriptionRequest reads the body of a request that manages one of the
+// signed in user's subscriptions, or one of their organisations', and finds
+// that subscription, see findManagedSubscription.
+func readSubscriptionRequest(e *core.RequestEvent) (map[string]interface{}, *core.Record, error) {
+	data, err := readRequestBody(e)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token := e.Request.Header.Get("Authorization")
+	user, err := e.App.FindAuthRecordByToken(token, core.TokenTypeAuth)
+	if err != nil {
+		e.App.Logger().Error("could not find auth record by token", "error", err)
+		return nil, nil, &requestError{http.StatusBadRequest, "could not find auth record by token"}
+	}
+
+	record, err := findManagedSubscription(e.App, user, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, record, nil
+}
+
+// respondManagedSubscription stores a subscription the user just changed and
+// responds with its record. The customer.subscription.updated event follows,
+// but the user expects to see the change right away. The stored
+// last_event_created is kept, so that event still applies.
+func respondManagedSubscription(e *core.RequestEvent, subscription *stripe.Subscription) error {
+	if _, err := upsertSubscription(e.App, subscription, 0); err != nil {
+		e.App.Logger().Error("could not save changed subscription", "subscriptionId", subscription.ID, "error", err)
+	}
+
+	record, err := e.App.FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
+	if err != nil {
+		return e.JSON(http.StatusOK, subscription)
+	}
+	return e.JSON(http.StatusOK, record)
+}
+
+// handleCancelSubscription cancels the user's subscription at the end of the
+// current period, or right away when "immediately" is true. The optional
+// "feedback" and "comment" tell why the user canceled.
+func handleCancelSubscription(e *core.RequestEvent) error {
+	data, record, err := readSubscriptionRequest(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+	subscriptionID := record.GetString("subscription_id")
+
+	feedback, comment, err := parseCancellationDetails(data)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+
+	var subscription *stripe.Subscription
+	if immediately, _ := data["immediately"].(bool); immediately {
+		params := &stripe.SubscriptionCancelParams{}
+		if feedback != nil || comment != nil {
+			params.CancellationDetails = &stripe.SubscriptionCancelCancellationDetailsParams{
+				Feedback: feedback,
+				Comment:  comment,
+			}
+		}
+		subscription, err = stripeSubscription.Cancel(subscriptionID, params)
+	} else {
+		params := &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		}
+		if feedback != nil || comment != nil {
+			params.CancellationDetails = &stripe.SubscriptionCancellationDetailsParams{
+				Feedback: feedback,
+				Comment:  comment,
+			}
+		}
+		subscription, err = stripeSubscription.Update(subscriptionID, params)
+	}
+	if err != nil {
+		e.App.Logger().Error("could not cancel subscription", "subscriptionId", subscriptionID, "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not cancel subscription"})
+	}
+
+	return respondManagedSubscription(e, subscription)
+}
+
+// handleReactivateSubscription undoes the scheduled cancellation of the
+// user's subscription.
+func handleReactivateSubscription(e *core.RequestEvent) error {
+	_, record, err := readSubscriptionRequest(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+	subscriptionID := record.GetString("subscription_id")
+
+	if !record.GetBool("cancel_at_period_end") {
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "subscription is not scheduled to cancel"})
+	}
+
+	subscription, err := stripeSubscription.Update(subscriptionID, &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	})
+	if err != nil {
+		e.App.Logger().Error("could not reactivate subscription", "subscriptionId", subscriptionID, "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not reactivate subscription"})
+	}
+
+	return respondManagedSubscription(e, subscription)
+}
+
+// handlePauseSubscription pauses payment collection of the user's
+// subscription. The optional "behavior" says what happens to the invoices
+// created while paused (keep_as_draft, mark_uncollectible or void, the
+// default) and "resumes_at" when collection resumes by itself.
+func handlePauseSubscription(e *core.RequestEvent) error {
+	data, record, err := readSubscriptionRequest(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+	subscriptionID := record.GetString("subscription_id")
+
+	pauseParams := &stripe.SubscriptionPauseCollectionParams{
+		Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+	}
+	if rawBehavior, ok := data["behavior"]; ok {
+		behavior, _ := rawBehavior.(string)
+		switch stripe.SubscriptionPauseCollectionBehavior(behavior) {
+		case stripe.SubscriptionPauseCollectionBehaviorKeepAsDraft,
+			stripe.SubscriptionPauseCollectionBehaviorMarkUncollectible,
+			stripe.SubscriptionPauseCollectionBehaviorVoid:
+			pauseParams.Behavior = stripe.String(behavior)
+		default:
+			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid behavior"})
+		}
+	}
+	if rawResumesAt, ok := data["resumes_at"]; ok {
+		resumesAt, ok := rawResumesAt.(float64)
+		if !ok || int64(resumesAt) <= time.Now().Unix() {
+			return e.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid resumes_at"})
+		}
+		pauseParams.ResumesAt = stripe.Int64(int64(resumesAt))
+	}
+
+	subscription, err := stripeSubscription.Update(subscriptionID, &stripe.SubscriptionParams{
+		PauseCollection: pauseParams,
+	})
+	if err != nil {
+		e.App.Logger().Error("could not pause subscription", "subscriptionId", subscriptionID, "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not pause subscription"})
+	}
+
+	return respondManagedSubscription(e, subscription)
+}
+
+// handleResumeSubscription resumes payment collection of the user's paused
+// subscription.
+func handleResumeSubscription(e *core.RequestEvent) error {
+	_, record, err := readSubscriptionRequest(e)
+	if err != nil {
+		return respondRequestError(e, err)
+	}
+	subscriptionID := record.GetString("subscription_id")
+
+	if record.GetString("pause_behavior") == "" {
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "subscription is not paused"})
+	}
+
+	// an empty pause_collection lifts the pause
+	params := &stripe.SubscriptionParams{}
+	params.AddExtra("pause_collection", "")
+	subscription, err := stripeSubscription.Update(subscriptionID, params)
+	if err != nil {
+		e.App.Logger().Error("could not resume subscription", "subscriptionId", subscriptionID, "error", err)
+		return e.JSON(http.StatusBadRequest, map[string]string{"failure": "could not resume subscription"})
+	}
+
+	return respondManagedSubscription(e, subscription)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestSubscriptionActions(t *testing.T) {
+	setup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario, ownerID string, configure func(record *core.Record)) {
+		setupStripeMock(t)
+
+		user, token := authTokenForTestUser(t, app)
+		if ownerID == "" {
+			ownerID = user.Id
+		}
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", ownerID)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_plan")
+		subscription.Set("user_id", ownerID)
+		subscription.Set("price_id", "price_base")
+		subscription.Set("status", "active")
+		if configure != nil {
+			configure(subscription)
+		}
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+
+	// orgSetup stores sub_plan as a subscription of an organisation the
+	// signed in user is a member of with role
+	orgSetup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario, role string) {
+		setupStripeMock(t)
+		organisation := ensureOrganisationRecord(t, app)
+
+		user, token := authTokenForTestUser(t, app)
+		member := core.NewRecord(ensureOrganisationMemberCollection(t, app))
+		member.Set("organisation_id", organisation.Id)
+		member.Set("user_id", user.Id)
+		member.Set("role", role)
+		if err := app.Save(member); err != nil {
+			t.Fatal(err)
+		}
+
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("organisation_id", organisation.Id)
+		customer.Set("stripe_customer_id", "cus_test")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_plan")
+		subscription.Set("organisation_id", organisation.Id)
+		subscription.Set("price_id", "price_base")
+		subscription.Set("status", "active")
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+
+	storedSubscription := func(t testing.TB, app *tests.TestApp) *core.Record {
+		record, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_plan")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+
+	resumesAt := time.Now().Add(30 * 24 * time.Hour).Unix()
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "cancel requires auth",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"could not find auth record by token"`,
+			},
+		},
+		{
+			name:           "cancel at period end",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"cancel_at_period_end":true`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "", func(record *core.Record) {
+					record.Set("last_event_created", int64ToISODate(1700000000))
+				})
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				record := storedSubscription(t, app)
+				if !record.GetBool("cancel_at_period_end") {
+					t.Fatal("Expected subscription to be scheduled to cancel")
+				}
+				// the customer.subscription.updated event of the change must still apply
+				if record.GetDateTime("last_event_created").Time().Unix() != 1700000000 {
+					t.Fatalf("Expected last_event_created to be kept, got %s", record.GetString("last_event_created"))
+				}
+			},
+		},
+		{
+			name:           "cancel immediately",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			body:           `{"immediately":true}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"status":"canceled"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "", nil)
+			},
+		},
+		{
+			name:           "subscription of another user can't be canceled",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			body:           `{"subscription_id":"sub_plan","immediately":true}`,
+			expectedStatus: http.StatusNotFound,
+			expectedContent: []string{
+				`"failure":"subscription not found"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "someoneelse0000", nil)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if storedSubscription(t, app).GetString("status") != "active" {
+					t.Fatal("Expected the other user's subscription to stay active")
+				}
+			},
+		},
+		{
+			name:           "billing admin cancels the organisation's subscription",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			body:           `{"organisation_id":"orgtest00000000"}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"cancel_at_period_end":true`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup(t, app, scenario, organisationRoleBillingAdmin)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if !storedSubscription(t, app).GetBool("cancel_at_period_end") {
+					t.Fatal("Expected the organisation's subscription to be scheduled to cancel")
+				}
+			},
+		},
+		{
+			name:           "billing admin pauses the organisation's subscription by subscription_id",
+			method:         http.MethodPost,
+			url:            "/pause-subscription",
+			body:           `{"subscription_id":"sub_plan"}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"pause_behavior":"void"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup(t, app, scenario, organisationRoleBillingAdmin)
+			},
+		},
+		{
+			name:           "plain members can't cancel the organisation's subscription",
+			method:         http.MethodPost,
+			url:            "/cancel-subscription",
+			body:           `{"subscription_id":"sub_plan","immediately":true}`,
+			expectedStatus: http.StatusNotFound,
+			expectedContent: []string{
+				`"failure":"subscription not found"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				orgSetup(t, app, scenario, organisationRoleMember)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if storedSubscription(t, app).GetString("status") != "active" {
+					t.Fatal("Expected the organisation's subscription to stay active")
+				}
+			},
+		},
+		{
+			name:           "reactivate undoes the scheduled cancellation",
+			method:         http.MethodPost,
+			url:            "/reactivate-subscription",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"cancel_at_period_end":false`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "", func(record *core.Record) {
+					record.Set("cancel_at_period_end", true)
+				})
+			},
+		},
+		{
+			name:           "reactivate requires a scheduled cancellation",
+			method:         http.MethodPost,
+			url:            "/reactivate-subscription",
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"subscription is not scheduled to cancel"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "", nil)
+			},
+		},
+		{
+			name:           "pause collection",
+			method:         http.MethodPost,
+			url:            "/pause-subscription",
+			body:           fmt.Sprintf(`{"behavior":"keep_as_draft","resumes_at":%d}`, resumesAt),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"pause_behavior":"keep_as_draft"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "", nil)
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				if storedSubscription(t, app).GetDateTime("pause_resumes_at").Time().Unix() != resumesAt {
+					t.Fatal("Expected pause_resumes_at to be stored")
+				}
+			},
+		},
+		{
+			name:           "pause with an invalid behavior",
+			method:         http.MethodPost,
+			url:            "/pause-subscription",
+			body:           `{"behavior":"forever"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedContent: []string{
+				`"failure":"invalid behavior"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "", nil)
+			},
+		},
+		{
+			name:           "resume collection",
+			method:         http.MethodPost,
+			url:            "/resume-subscription",
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"pause_behavior":""`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "", func(record *core.Record) {
+					record.Set("pause_behavior", "void")
+				})
+			},
+		},
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func ensureSubscriptionItemCollection(t testing.TB, app *tests.TestApp) *core.Collection {
+	t.Helper()
+
+	collection, err := app.FindCollectionByNameOrId("subscription_item")
+	if err == nil && collection != nil {
+		return collection
+	}
+
+	collection = core.NewBaseCollection("subscription_item")
+	collection.Fields.Add(
+		&core.TextField{Name: "item_id", Required: true},
+		&core.TextField{Name: "subscription_id", Required: true},
+		&core.TextField{Name: "user_id"},
+		&core.TextField{Name: "price_id"},
+		&core.TextField{Name: "product_id"},
+		&core.NumberField{Name: "quantity", OnlyInt: true},
+		&core.JSONField{Name: "metadata"},
+		&core.DateField{Name: "item_created"},
+	)
+
+	if err := app.Save(collection); err != nil {
+		t.Fatal(err)
+	}
+
+	return collection
+}
+
+func TestSubscriptionItems(t *testing.T) {
+	payload := []byte(fmt.Sprintf(`{"id":"evt_items","object":"event","api_version":"%s","created":1700000000,"type":"customer.subscription.updated","data":{"object":{"id":"sub_items","object":"subscription","customer":"cus_test","status":"active","items":{"object":"list","has_more":false,"data":[`+
+		`{"id":"si_base","object":"subscription_item","created":1699000000,"quantity":1,"price":{"id":"price_base","object":"price","product":"prod_base"}},`+
+		`{"id":"si_seats","object":"subscription_item","created":1699000100,"quantity":5,"price":{"id":"price_seats","object":"price","product":"prod_seats"}}`+
+		`]}}}}`, stripe.APIVersion))
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  "whsec_test",
+	})
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "subscription items are mirrored and removed items deleted",
+			method:         http.MethodPost,
+			url:            "/stripe",
+			body:           string(payload),
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"success":"data was received"`,
+			},
+			headers: map[string]string{
+				"Stripe-Signature": signed.Header,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				WHSEC = "whsec_test"
+				setupStripeMock(t)
+				ensureStripeEventCollection(t, app)
+				ensureSubscriptionCollection(t, app)
+
+				customer := core.NewRecord(ensureCustomerCollection(t, app))
+				customer.Set("user_id", "usertest0000000")
+				customer.Set("stripe_customer_id", "cus_test")
+				if err := app.Save(customer); err != nil {
+					t.Fatal(err)
+				}
+
+				removed := core.NewRecord(ensureSubscriptionItemCollection(t, app))
+				removed.Set("item_id", "si_removed")
+				removed.Set("subscription_id", "sub_items")
+				if err := app.Save(removed); err != nil {
+					t.Fatal(err)
+				}
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				subscription, err := app.FindFirstRecordByData("subscription", "subscription_id", "sub_items")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if subscription.GetString("price_id") != "price_base" || subscription.GetInt("quantity") != 1 {
+					t.Fatalf("Expected the first item to be the primary item, got %s %d", subscription.GetString("price_id"), subscription.GetInt("quantity"))
+				}
+
+				items, err := app.FindAllRecords("subscription_item", dbx.HashExp{"subscription_id": "sub_items"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(items) != 2 {
+					t.Fatalf("Expected 2 subscription items, got %d", len(items))
+				}
+
+				seats, err := app.FindFirstRecordByData("subscription_item", "item_id", "si_seats")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if seats.GetString("price_id") != "price_seats" || seats.GetString("product_id") != "prod_seats" || seats.GetInt("quantity") != 5 {
+					t.Fatalf("Unexpected seats item %s %s %d", seats.GetString("price_id"), seats.GetString("product_id"), seats.GetInt("quantity"))
+				}
+				if seats.GetString("user_id") != "usertest0000000" {
+					t.Fatalf("Expected item user_id to be usertest0000000, got %s", seats.GetString("user_id"))
+				}
+				if seats.GetDateTime("item_created").IsZero() {
+					t.Fatal("Expected item_created to be set")
+				}
+			},
+		},
+	})
+}
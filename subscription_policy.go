@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// duplicate subscription policies
+const (
+	duplicateSubscriptionPolicyReject = "reject"
+	duplicateSubscriptionPolicyPortal = "portal"
+	duplicateSubscriptionPolicyAllow  = "allow"
+)
+
+// isStackableProduct reports whether a product may be subscribed to next to
+// other subscriptions, which is marked with "stackable" set to "true" in its
+// Stripe metadata.
+func isStackableProduct(app core.App, productID string) bool {
+	product, err := app.FindFirstRecordByData("product", "product_id", productID)
+	if err != nil {
+		return false
+	}
+	var metadata map[string]string
+	if err := product.UnmarshalJSONField("metadata", &metadata); err != nil {
+		return false
+	}
+	return metadata["stackable"] == "true"
+}
+
+// findBlockingSubscription returns the active or trialing subscription of the
+// owner that keeps them from subscribing to the recurring items, or nil when
+// they may subscribe. Subscriptions to stackable products neither block nor
+// are blocked.
+func findBlockingSubscription(app core.App, owner *billingOwner, items []checkoutItem) (*core.Record, error) {
+	stackable := true
+	for _, item := range items {
+		if item.PriceType == "recurring" && !isStackableProduct(app, item.ProductID) {
+			stackable = false
+			break
+		}
+	}
+	if stackable {
+		return nil, nil
+	}
+
+	records, err := app.FindRecordsByFilter(
+		"subscription",
+		owner.field()+" = {:ownerId} && (status = {:active} || status = {:trialing})",
+		"",
+		0,
+		0,
+		dbx.Params{
+			"ownerId":  owner.id(),
+			"active":   stripe.SubscriptionStatusActive,
+			"trialing": stripe.SubscriptionStatusTrialing,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		price, err := app.FindFirstRecordByData("price", "price_id", record.GetString("price_id"))
+		if err == nil && isStackableProduct(app, price.GetString("product_id")) {
+			continue
+		}
+		return record, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestDuplicateSubscriptionPolicy(t *testing.T) {
+	setup := func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario, status string) {
+		setupStripeMock(t)
+		stripeSuccessURL = "https://example.com/success"
+		stripeCancelURL = "https://example.com/cancel"
+		stripeBillingReturnURL = "https://example.com/return"
+		lastBillingPortalSessionForm = nil
+		ensureCatalogPrice(t, app, "price_base", "recurring")
+		ensureCatalogPrice(t, app, "price_other", "recurring")
+		ensureCatalogPrice(t, app, "price_setup", "one_time")
+
+		addon := core.NewRecord(ensureProductCollection(t, app))
+		addon.Set("product_id", "prod_addon")
+		addon.Set("active", true)
+		addon.Set("metadata", map[string]string{"stackable": "true"})
+		if err := app.Save(addon); err != nil {
+			t.Fatal(err)
+		}
+		addonPrice := ensureCatalogPrice(t, app, "price_addon", "recurring")
+		addonPrice.Set("product_id", "prod_addon")
+		if err := app.Save(addonPrice); err != nil {
+			t.Fatal(err)
+		}
+
+		user, token := authTokenForTestUser(t, app)
+		customer := core.NewRecord(ensureCustomerCollection(t, app))
+		customer.Set("user_id", user.Id)
+		customer.Set("stripe_customer_id", "cus_existing")
+		if err := app.Save(customer); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription := core.NewRecord(ensureSubscriptionCollection(t, app))
+		subscription.Set("subscription_id", "sub_active")
+		subscription.Set("user_id", user.Id)
+		subscription.Set("price_id", "price_base")
+		subscription.Set("status", status)
+		if err := app.Save(subscription); err != nil {
+			t.Fatal(err)
+		}
+
+		scenario.Headers = map[string]string{
+			"Authorization": token,
+		}
+	}
+
+	runEndpointScenarios(t, []endpointScenario{
+		{
+			name:           "second subscription is rejected",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_other"},"quantity":1}`,
+			expectedStatus: http.StatusConflict,
+			expectedContent: []string{
+				`"failure":"user already has an active subscription"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "trialing")
+			},
+		},
+		{
+			name:           "portal policy opens the subscription update flow",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_other"},"quantity":1}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"bps_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "active")
+				stripeDuplicateSubscriptionPolicy = duplicateSubscriptionPolicyPortal
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				defer func() { stripeDuplicateSubscriptionPolicy = duplicateSubscriptionPolicyReject }()
+
+				form := lastBillingPortalSessionForm
+				if form.Get("flow_data[type]") != "subscription_update" {
+					t.Fatalf("Expected a subscription_update flow, got %q", form.Get("flow_data[type]"))
+				}
+				if form.Get("flow_data[subscription_update][subscription]") != "sub_active" {
+					t.Fatalf("Expected the flow to update sub_active, got %q", form.Get("flow_data[subscription_update][subscription]"))
+				}
+			},
+		},
+		{
+			name:           "allow policy creates a second subscription",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_other"},"quantity":1}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "active")
+				stripeDuplicateSubscriptionPolicy = duplicateSubscriptionPolicyAllow
+			},
+			after: func(t testing.TB, app *tests.TestApp, res *http.Response) {
+				stripeDuplicateSubscriptionPolicy = duplicateSubscriptionPolicyReject
+			},
+		},
+		{
+			name:           "stackable product can be added next to a subscription",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_addon"},"quantity":1}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "active")
+			},
+		},
+		{
+			name:           "canceled subscription doesn't block a new one",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_other"},"quantity":1}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "canceled")
+			},
+		},
+		{
+			name:           "one-time purchase is allowed next to a subscription",
+			method:         http.MethodPost,
+			url:            "/create-checkout-session",
+			body:           `{"price":{"id":"price_setup"},"quantity":1}`,
+			expectedStatus: http.StatusOK,
+			expectedContent: []string{
+				`"id":"cs_test"`,
+			},
+			setup: func(t testing.TB, app *tests.TestApp, scenario *tests.ApiScenario) {
+				setup(t, app, scenario, "active")
+			},
+		},
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestBackfillSubscriptionAccess(t *testing.T) {
+	app, err := tests.NewTestApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Cleanup()
+
+	collection := ensureSubscriptionCollection(t, app)
+	expected := map[string]bool{}
+	for _, subscription := range []struct {
+		id             string
+		status         string
+		paymentPending bool
+		access         bool
+	}{
+		{"sub_active", "active", false, true},
+		{"sub_trialing", "trialing", false, true},
+		{"sub_past_due", "past_due", false, true},
+		{"sub_pending", "active", true, false},
+		{"sub_canceled", "canceled", false, false},
+	} {
+		record := core.NewRecord(collection)
+		record.Set("subscription_id", subscription.id)
+		record.Set("status", subscription.status)
+		record.Set("payment_pending", subscription.paymentPending)
+		if err := app.Save(record); err != nil {
+			t.Fatal(err)
+		}
+		expected[subscription.id] = subscription.access
+	}
+
+	updated, err := backfillSubscriptionAccess(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 3 {
+		t.Fatalf("Expected 3 subscriptions to be granted access, got %d", updated)
+	}
+	for subscriptionID, access := range expected {
+		record, err := app.FindFirstRecordByData("subscription", "subscription_id", subscriptionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.GetBool("access") != access {
+			t.Fatalf("Expected access of %s to be %v", subscriptionID, access)
+		}
+	}
+
+	if updated, err = backfillSubscriptionAccess(app); err != nil || updated != 0 {
+		t.Fatalf("Expected a second backfill to update nothing, got %d (%v)", updated, err)
+	}
+}